@@ -0,0 +1,223 @@
+package conf
+
+import (
+	"bytes"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+
+	"v2ray.com/core/app/router"
+)
+
+func cidrIPLen(c *router.CIDR) int {
+	if len(c.Ip) == net.IPv4len {
+		return net.IPv4len
+	}
+	return net.IPv6len
+}
+
+// normalizeCIDR returns a copy of c with all host bits cleared.
+func normalizeCIDR(c *router.CIDR) *router.CIDR {
+	ipLen := cidrIPLen(c)
+	ip := make([]byte, ipLen)
+	copy(ip, c.Ip)
+	mask := net.CIDRMask(int(c.Prefix), ipLen*8)
+	for i := range ip {
+		ip[i] &= mask[i]
+	}
+	return &router.CIDR{
+		Ip:     ip,
+		Prefix: c.Prefix,
+	}
+}
+
+// cidrContains returns true if every address in b is also in a.
+func cidrContains(a, b *router.CIDR) bool {
+	if cidrIPLen(a) != cidrIPLen(b) || a.Prefix > b.Prefix {
+		return false
+	}
+	na := normalizeCIDR(a)
+	nb := normalizeCIDR(&router.CIDR{Ip: b.Ip, Prefix: a.Prefix})
+	return net.IP(na.Ip).Equal(net.IP(nb.Ip))
+}
+
+func cidrString(c *router.CIDR) string {
+	return net.IP(c.Ip).String() + "/" + strconv.Itoa(int(c.Prefix))
+}
+
+func cidrOverlaps(a, b *router.CIDR) bool {
+	return cidrContains(a, b) || cidrContains(b, a)
+}
+
+// ipInterval is an inclusive range of addresses of the same length.
+type ipInterval struct {
+	start net.IP
+	end   net.IP
+}
+
+func cidrInterval(c *router.CIDR) ipInterval {
+	n := normalizeCIDR(c)
+	mask := net.CIDRMask(int(n.Prefix), len(n.Ip)*8)
+	end := make(net.IP, len(n.Ip))
+	for i := range end {
+		end[i] = n.Ip[i] | ^mask[i]
+	}
+	return ipInterval{start: n.Ip, end: end}
+}
+
+// nextIP returns the address following ip, or false if ip is the last address.
+func nextIP(ip net.IP) (net.IP, bool) {
+	next := append(net.IP(nil), ip...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next, true
+		}
+	}
+	return nil, false
+}
+
+// prevIP returns the address preceding ip. ip must not be the first address.
+func prevIP(ip net.IP) net.IP {
+	prev := append(net.IP(nil), ip...)
+	for i := len(prev) - 1; i >= 0; i-- {
+		prev[i]--
+		if prev[i] != 0xff {
+			break
+		}
+	}
+	return prev
+}
+
+// mergeIntervals sorts intervals, and merges the overlapping and adjacent ones.
+func mergeIntervals(intervals []ipInterval) []ipInterval {
+	sort.Slice(intervals, func(i, j int) bool {
+		return bytes.Compare(intervals[i].start, intervals[j].start) < 0
+	})
+	var merged []ipInterval
+	for _, iv := range intervals {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if next, ok := nextIP(last.end); !ok || bytes.Compare(iv.start, next) <= 0 {
+				if bytes.Compare(iv.end, last.end) > 0 {
+					last.end = iv.end
+				}
+				continue
+			}
+		}
+		merged = append(merged, iv)
+	}
+	return merged
+}
+
+// subtractIntervals removes excluded from intervals in a single sweep. Both lists must be sorted and merged.
+func subtractIntervals(intervals, excluded []ipInterval) ([]ipInterval, bool) {
+	var result []ipInterval
+	changed := false
+	j := 0
+	for _, iv := range intervals {
+		for j < len(excluded) && bytes.Compare(excluded[j].end, iv.start) < 0 {
+			j++
+		}
+		start := iv.start
+		for k := j; k < len(excluded) && bytes.Compare(excluded[k].start, iv.end) <= 0; k++ {
+			changed = true
+			if bytes.Compare(excluded[k].start, start) > 0 {
+				result = append(result, ipInterval{start: start, end: prevIP(excluded[k].start)})
+			}
+			next, ok := nextIP(excluded[k].end)
+			if !ok || bytes.Compare(next, iv.end) > 0 {
+				start = nil
+				break
+			}
+			start = next
+		}
+		if start != nil {
+			result = append(result, ipInterval{start: start, end: iv.end})
+		}
+	}
+	return result, changed
+}
+
+// subtractCIDRs removes all addresses in excluded from cidrs. It also reports whether any address was removed.
+// CIDRs of an address family that is not affected by excluded are returned as is.
+func subtractCIDRs(cidrs []*router.CIDR, excluded []*router.CIDR) ([]*router.CIDR, bool) {
+	var result []*router.CIDR
+	changed := false
+	for _, ipLen := range []int{net.IPv4len, net.IPv6len} {
+		var family []*router.CIDR
+		var intervals, excludedIntervals []ipInterval
+		for _, c := range cidrs {
+			if cidrIPLen(c) == ipLen {
+				family = append(family, c)
+				intervals = append(intervals, cidrInterval(c))
+			}
+		}
+		for _, e := range excluded {
+			if cidrIPLen(e) == ipLen {
+				excludedIntervals = append(excludedIntervals, cidrInterval(e))
+			}
+		}
+		if len(family) == 0 || len(excludedIntervals) == 0 {
+			result = append(result, family...)
+			continue
+		}
+
+		remaining, removed := subtractIntervals(mergeIntervals(intervals), mergeIntervals(excludedIntervals))
+		if !removed {
+			result = append(result, family...)
+			continue
+		}
+		changed = true
+		for _, iv := range remaining {
+			result = append(result, rangeToCIDRs(iv.start, iv.end)...)
+		}
+	}
+	return result, changed
+}
+
+// allCIDRs returns the CIDRs covering the whole IPv4 and IPv6 address space.
+func allCIDRs() []*router.CIDR {
+	return []*router.CIDR{
+		{Ip: make([]byte, net.IPv4len), Prefix: 0},
+		{Ip: make([]byte, net.IPv6len), Prefix: 0},
+	}
+}
+
+// rangeToCIDRs returns the smallest list of CIDRs that covers all addresses from start to end, inclusively.
+// start and end must be of the same length.
+func rangeToCIDRs(start, end net.IP) []*router.CIDR {
+	bits := len(start) * 8
+	current := new(big.Int).SetBytes(start)
+	last := new(big.Int).SetBytes(end)
+	one := big.NewInt(1)
+
+	var cidrs []*router.CIDR
+	for current.Cmp(last) <= 0 {
+		size := int(current.TrailingZeroBits())
+		if current.Sign() == 0 || size > bits {
+			size = bits
+		}
+		for size > 0 {
+			blockEnd := new(big.Int).Lsh(one, uint(size))
+			blockEnd.Add(blockEnd, current)
+			blockEnd.Sub(blockEnd, one)
+			if blockEnd.Cmp(last) <= 0 {
+				break
+			}
+			size--
+		}
+
+		ip := make([]byte, len(start))
+		b := current.Bytes()
+		copy(ip[len(ip)-len(b):], b)
+		cidrs = append(cidrs, &router.CIDR{
+			Ip:     ip,
+			Prefix: uint32(bits - size),
+		})
+
+		current.Add(current, new(big.Int).Lsh(one, uint(size)))
+	}
+	return cidrs
+}
@@ -0,0 +1,53 @@
+package command
+
+import (
+	"fmt"
+	"os"
+
+	"v2ray.com/core/common"
+	"v2ray.com/ext/tools/conf/serial"
+	"v2ray.com/ext/tools/control"
+)
+
+type BalancerCommand struct{}
+
+func (c *BalancerCommand) Name() string {
+	return "balancer"
+}
+
+func (c *BalancerCommand) Description() control.Description {
+	return control.Description{
+		Short: "Preview outbounds of balancers.",
+		Usage: []string{
+			"v2ctl balancer < config.json",
+			"List the outbounds that each balancer selects from.",
+		},
+	}
+}
+
+func (c *BalancerCommand) Execute(args []string) error {
+	jsonConfig, err := serial.DecodeJSONConfig(os.Stdin)
+	if err != nil {
+		return newError("failed to parse json config").Base(err)
+	}
+	if jsonConfig.RouterConfig == nil || len(jsonConfig.RouterConfig.Balancers) == 0 {
+		return newError("no balancer is specified")
+	}
+
+	outboundTags := jsonConfig.OutboundTags()
+	for _, balancer := range jsonConfig.RouterConfig.Balancers {
+		if _, err := balancer.Build(); err != nil {
+			return newError("invalid balancer ", balancer.Tag).Base(err)
+		}
+		// The router picks a random outbound of a balancer, so there is no strategy or health state to show.
+		fmt.Println(balancer.Tag + ":")
+		for _, tag := range balancer.SelectOutbounds(outboundTags) {
+			fmt.Println("   ", tag)
+		}
+	}
+	return nil
+}
+
+func init() {
+	common.Must(control.RegisterCommand(&BalancerCommand{}))
+}
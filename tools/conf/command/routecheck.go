@@ -0,0 +1,51 @@
+package command
+
+import (
+	"fmt"
+	"os"
+
+	"v2ray.com/core/common"
+	"v2ray.com/ext/tools/conf/serial"
+	"v2ray.com/ext/tools/control"
+)
+
+type RouteCheckCommand struct{}
+
+func (c *RouteCheckCommand) Name() string {
+	return "routecheck"
+}
+
+func (c *RouteCheckCommand) Description() control.Description {
+	return control.Description{
+		Short: "Find unreachable routing rules.",
+		Usage: []string{
+			"v2ctl routecheck < config.json",
+			"Report routing rules that are shadowed by earlier rules, or have matchers that resolve to nothing,",
+			"and balancers that are not referenced by any rule.",
+		},
+	}
+}
+
+func (c *RouteCheckCommand) Execute(args []string) error {
+	jsonConfig, err := serial.DecodeJSONConfig(os.Stdin)
+	if err != nil {
+		return newError("failed to parse json config").Base(err)
+	}
+	if jsonConfig.RouterConfig == nil {
+		return newError("routing config is not specified")
+	}
+
+	issues, err := jsonConfig.RouterConfig.Check()
+	if err != nil {
+		return newError("failed to build routing config").Base(err)
+	}
+
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+	return nil
+}
+
+func init() {
+	common.Must(control.RegisterCommand(&RouteCheckCommand{}))
+}
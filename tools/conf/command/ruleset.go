@@ -0,0 +1,90 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"v2ray.com/core/common"
+	json_reader "v2ray.com/ext/encoding/json"
+	"v2ray.com/ext/tools/conf"
+	"v2ray.com/ext/tools/control"
+)
+
+type RulesetCommand struct{}
+
+func (c *RulesetCommand) Name() string {
+	return "ruleset"
+}
+
+func (c *RulesetCommand) Description() control.Description {
+	return control.Description{
+		Short: "Manage cached rule sets.",
+		Usage: []string{
+			"v2ctl ruleset update <url>...",
+			"v2ctl ruleset update < config.json",
+			"Fetch rule sets and refresh their cached copies. If no URL is given, all rule sets referenced in the config are updated.",
+		},
+	}
+}
+
+// collectRulesets returns all URLs referenced by "ruleset:" in a JSON value.
+func collectRulesets(v interface{}, urls map[string]bool) {
+	switch v := v.(type) {
+	case string:
+		v = strings.TrimPrefix(v, "!")
+		if strings.HasPrefix(v, "ruleset:") {
+			urls[v[8:]] = true
+		}
+	case []interface{}:
+		for _, e := range v {
+			collectRulesets(e, urls)
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			collectRulesets(k, urls)
+			collectRulesets(e, urls)
+		}
+	}
+}
+
+func (c *RulesetCommand) Execute(args []string) error {
+	if len(args) < 1 || args[0] != "update" {
+		return newError("unknown subcommand, expecting \"update\"")
+	}
+
+	urls := args[1:]
+	if len(urls) == 0 {
+		var config interface{}
+		if err := json.NewDecoder(&json_reader.Reader{Reader: os.Stdin}).Decode(&config); err != nil {
+			return newError("failed to parse json config").Base(err)
+		}
+		set := make(map[string]bool)
+		collectRulesets(config, set)
+		for url := range set {
+			urls = append(urls, url)
+		}
+		sort.Strings(urls)
+	}
+
+	failed := 0
+	for _, url := range urls {
+		ruleset, err := conf.DefaultRulesetLoader.Update(url)
+		if err != nil {
+			fmt.Printf("%s: %v\n", url, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: %d domains, %d CIDRs\n", url, len(ruleset.Domain), len(ruleset.Cidr))
+	}
+	if failed > 0 {
+		return newError("failed to update ", failed, " rule sets")
+	}
+	return nil
+}
+
+func init() {
+	common.Must(control.RegisterCommand(&RulesetCommand{}))
+}
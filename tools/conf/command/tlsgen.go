@@ -0,0 +1,38 @@
+package command
+
+import (
+	"os"
+
+	"v2ray.com/core/common"
+	"v2ray.com/ext/tools/conf/serial"
+	"v2ray.com/ext/tools/control"
+)
+
+type TLSGenerateCommand struct{}
+
+func (c *TLSGenerateCommand) Name() string {
+	return "tlsgen"
+}
+
+func (c *TLSGenerateCommand) Description() control.Description {
+	return control.Description{
+		Short: "Generate certificates of TLS settings.",
+		Usage: []string{
+			"v2ctl tlsgen < config.json",
+			"Write the certificate and key files of all TLS certificates with \"generate\" settings.",
+			"Existing files are kept, unless they don't match the settings or are near expiry.",
+		},
+	}
+}
+
+func (c *TLSGenerateCommand) Execute(args []string) error {
+	jsonConfig, err := serial.DecodeJSONConfig(os.Stdin)
+	if err != nil {
+		return newError("failed to parse json config").Base(err)
+	}
+	return jsonConfig.GenerateCertificates()
+}
+
+func init() {
+	common.Must(control.RegisterCommand(&TLSGenerateCommand{}))
+}
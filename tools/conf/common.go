@@ -3,6 +3,7 @@ package conf
 import (
 	"encoding/json"
 	"os"
+	"sort"
 	"strings"
 
 	"v2ray.com/core/common/net"
@@ -121,7 +122,10 @@ func parseStringPort(data []byte) (net.Port, net.Port, error) {
 		s = s[4:]
 		s = os.Getenv(s)
 	}
+	return parsePortPair(s)
+}
 
+func parsePortPair(s string) (net.Port, net.Port, error) {
 	pair := strings.SplitN(s, "-", 2)
 	if len(pair) == 0 {
 		return net.Port(0), net.Port(0), newError("Config: Invalid port range: ", s)
@@ -176,6 +180,89 @@ func (v *PortRange) UnmarshalJSON(data []byte) error {
 	return newError("invalid port range: ", string(data))
 }
 
+// PortList is a list of non-overlapping port ranges. It can be parsed from a port number,
+// a comma separated string such as "80,443,8000-9000", or a JSON array of both.
+type PortList struct {
+	Range []PortRange
+}
+
+func (v *PortList) Build() []*net.PortRange {
+	ranges := make([]*net.PortRange, 0, len(v.Range))
+	for i := range v.Range {
+		ranges = append(ranges, v.Range[i].Build())
+	}
+	return ranges
+}
+
+func (v *PortList) parseString(s string) error {
+	if strings.HasPrefix(s, "env:") {
+		s = os.Getenv(s[4:])
+	}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		from, to, err := parsePortPair(item)
+		if err != nil {
+			return newError("invalid port range: ", item).Base(err)
+		}
+		if from > to {
+			return newError("invalid port range ", from, " -> ", to)
+		}
+		v.Range = append(v.Range, PortRange{From: uint32(from), To: uint32(to)})
+	}
+	return nil
+}
+
+func (v *PortList) parseItem(data []byte) error {
+	port, err := parseIntPort(data)
+	if err == nil {
+		v.Range = append(v.Range, PortRange{From: uint32(port), To: uint32(port)})
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		return v.parseString(s)
+	}
+
+	return newError("invalid port: ", string(data))
+}
+
+// UnmarshalJSON implements encoding/json.Unmarshaler.UnmarshalJSON
+func (v *PortList) UnmarshalJSON(data []byte) error {
+	v.Range = nil
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err == nil {
+		for _, item := range items {
+			if err := v.parseItem(item); err != nil {
+				return err
+			}
+		}
+	} else if err := v.parseItem(data); err != nil {
+		return err
+	}
+
+	if len(v.Range) == 0 {
+		return newError("empty port list: ", string(data))
+	}
+
+	sorted := make([]PortRange, len(v.Range))
+	copy(sorted, v.Range)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].From < sorted[j].From
+	})
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].From <= sorted[i-1].To {
+			return newError("overlapping port ranges: ", sorted[i-1].From, "-", sorted[i-1].To, " and ", sorted[i].From, "-", sorted[i].To)
+		}
+	}
+
+	return nil
+}
+
 type User struct {
 	EmailString string `json:"email"`
 	LevelByte   byte   `json:"level"`
@@ -3,6 +3,7 @@ package conf_test
 import (
 	"encoding/json"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -184,6 +185,57 @@ func TestOverRangeStringPort(t *testing.T) {
 	}
 }
 
+func TestStringPortList(t *testing.T) {
+	var portList PortList
+	common.Must(json.Unmarshal([]byte("\"80, 443,8000-9000\""), &portList))
+
+	if r := cmp.Diff(portList, PortList{
+		Range: []PortRange{
+			{From: 80, To: 80},
+			{From: 443, To: 443},
+			{From: 8000, To: 9000},
+		},
+	}); r != "" {
+		t.Error(r)
+	}
+}
+
+func TestArrayPortList(t *testing.T) {
+	var portList PortList
+	common.Must(json.Unmarshal([]byte("[53, \"80,443\", \"8000-9000\"]"), &portList))
+
+	if r := cmp.Diff(portList, PortList{
+		Range: []PortRange{
+			{From: 53, To: 53},
+			{From: 80, To: 80},
+			{From: 443, To: 443},
+			{From: 8000, To: 9000},
+		},
+	}); r != "" {
+		t.Error(r)
+	}
+}
+
+func TestInvalidPortList(t *testing.T) {
+	testCases := []struct {
+		input string
+		err   string
+	}{
+		{"\"80,8000-9000,8080\"", "overlapping port ranges: 8000-9000 and 8080-8080"},
+		{"[80, 80]", "overlapping port ranges: 80-80 and 80-80"},
+		{"\"\"", "empty port list"},
+		{"[]", "empty port list"},
+		{"\"900-800\"", "invalid port range 900 -> 800"},
+		{"[70000]", "invalid port: 70000"},
+	}
+	for _, testCase := range testCases {
+		var portList PortList
+		if err := json.Unmarshal([]byte(testCase.input), &portList); err == nil || !strings.Contains(err.Error(), testCase.err) {
+			t.Error("expected error ", testCase.err, " for ", testCase.input, ", but got ", err)
+		}
+	}
+}
+
 func TestUserParsing(t *testing.T) {
 	user := new(User)
 	common.Must(json.Unmarshal([]byte(`{
@@ -1,19 +1,28 @@
 package conf
 
 import (
+	"bytes"
 	"encoding/json"
+	"math/big"
+	stdnet "net"
+	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 
 	"v2ray.com/core/app/dns"
+	"v2ray.com/core/app/dns/fakedns"
 	"v2ray.com/core/app/router"
+	"v2ray.com/core/common"
 	"v2ray.com/core/common/net"
+	"v2ray.com/ext/sysio"
 )
 
 type NameServerConfig struct {
-	Address *Address
-	Port    uint16
-	Domains []string
+	Address   *Address
+	Port      uint16
+	Domains   []string
+	ExpectIPs StringList
 }
 
 func (c *NameServerConfig) UnmarshalJSON(data []byte) error {
@@ -25,14 +34,16 @@ func (c *NameServerConfig) UnmarshalJSON(data []byte) error {
 	}
 
 	var advanced struct {
-		Address *Address `json:"address"`
-		Port    uint16   `json:"port"`
-		Domains []string `json:"domains"`
+		Address   *Address   `json:"address"`
+		Port      uint16     `json:"port"`
+		Domains   []string   `json:"domains"`
+		ExpectIPs StringList `json:"expectIps"`
 	}
 	if err := json.Unmarshal(data, &advanced); err == nil {
 		c.Address = advanced.Address
 		c.Port = advanced.Port
 		c.Domains = advanced.Domains
+		c.ExpectIPs = advanced.ExpectIPs
 		return nil
 	}
 
@@ -54,68 +65,623 @@ func toDomainMatchingType(t router.Domain_Type) dns.DomainMatchingType {
 	}
 }
 
+func toRouterDomainType(t dns.DomainMatchingType) router.Domain_Type {
+	switch t {
+	case dns.DomainMatchingType_Subdomain:
+		return router.Domain_Domain
+	case dns.DomainMatchingType_Full:
+		return router.Domain_Full
+	case dns.DomainMatchingType_Keyword:
+		return router.Domain_Plain
+	case dns.DomainMatchingType_Regex:
+		return router.Domain_Regex
+	default:
+		panic("unknown domain matching type")
+	}
+}
+
+// nameServerSchemes are the supported schemes of name server URLs, and their default ports.
+var nameServerSchemes = map[string]uint32{
+	"udp":         53,
+	"tcp":         53,
+	"tls":         853,
+	"https":       443,
+	"https+local": 443,
+}
+
+// parseNameServerURL parses a name server in the form of "scheme://host[:port][/path]".
+// DNS over HTTPS servers are passed to the DNS client by their URLs, while the others are passed by their endpoints.
+func parseNameServerURL(rawURL string) (*net.Endpoint, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, newError("invalid name server URL: ", rawURL).Base(err)
+	}
+	scheme := strings.ToLower(u.Scheme)
+	defaultPort, found := nameServerSchemes[scheme]
+	if !found {
+		return nil, newError("unsupported scheme of name server: ", rawURL)
+	}
+	switch scheme {
+	case "tls":
+		return nil, newError("DNS over TLS is unsupported by the DNS client, use https:// instead: ", rawURL)
+	case "tcp":
+		return nil, newError("DNS over TCP is unsupported by the DNS client, use udp:// or https:// instead: ", rawURL)
+	}
+	if u.User != nil || len(u.Fragment) > 0 {
+		return nil, newError("user info and fragment are not allowed in name server URL: ", rawURL)
+	}
+
+	host := u.Hostname()
+	if len(host) == 0 {
+		return nil, newError("empty host in name server URL: ", rawURL)
+	}
+	address := net.ParseAddress(host)
+	if !address.Family().IsIP() {
+		domain, err := normalizeDomain(host)
+		if err != nil {
+			return nil, newError("invalid host in name server URL: ", rawURL).Base(err)
+		}
+		address = net.DomainAddress(domain)
+	}
+
+	port := defaultPort
+	if p := u.Port(); len(p) > 0 {
+		parsed, err := strconv.ParseUint(p, 10, 16)
+		if err != nil || parsed == 0 {
+			return nil, newError("invalid port in name server URL: ", rawURL)
+		}
+		port = uint32(parsed)
+	}
+
+	if scheme == "https" || scheme == "https+local" {
+		if len(u.Path) == 0 || u.Path == "/" {
+			return nil, newError("path of DNS over HTTPS server is not specified: ", rawURL)
+		}
+		if len(u.RawQuery) > 0 {
+			return nil, newError("query is not allowed in DNS over HTTPS server URL: ", rawURL)
+		}
+		// address.String() wraps IPv6 addresses in brackets, which JoinHostPort adds as well.
+		hostname := address.String()
+		if address.Family().IsIP() {
+			hostname = address.IP().String()
+		}
+		normalized := &url.URL{
+			Scheme: scheme,
+			Host:   stdnet.JoinHostPort(hostname, strconv.Itoa(int(port))),
+			Path:   u.Path,
+		}
+		return &net.Endpoint{
+			Network: net.Network_TCP,
+			Address: net.NewIPOrDomain(net.DomainAddress(normalized.String())),
+			Port:    port,
+		}, nil
+	}
+
+	if (len(u.Path) > 0 && u.Path != "/") || len(u.RawQuery) > 0 {
+		return nil, newError("path and query are not allowed in name server URL: ", rawURL)
+	}
+	return &net.Endpoint{
+		Network: net.Network_UDP,
+		Address: net.NewIPOrDomain(address),
+		Port:    port,
+	}, nil
+}
+
+// Build implements Buildable. If the address is a URL, the port is taken from the URL instead of the port field.
 func (c *NameServerConfig) Build() (*dns.NameServer, error) {
 	if c.Address == nil {
 		return nil, newError("NameServer address is not specified.")
 	}
 
-	var domains []*dns.NameServer_PriorityDomain
-
-	for _, d := range c.Domains {
-		parsedDomain, err := parseDomainRule(d)
+	endpoint := &net.Endpoint{
+		Network: net.Network_UDP,
+		Address: c.Address.Build(),
+		Port:    uint32(c.Port),
+	}
+	if c.Address.Family().IsDomain() && strings.Contains(c.Address.Domain(), "://") {
+		var err error
+		endpoint, err = parseNameServerURL(c.Address.Domain())
 		if err != nil {
-			return nil, newError("invalid domain rule: ", d).Base(err)
+			return nil, err
 		}
+	}
+
+	var domains []*dns.NameServer_PriorityDomain
 
-		for _, pd := range parsedDomain {
-			domains = append(domains, &dns.NameServer_PriorityDomain{
-				Type:   toDomainMatchingType(pd.Type),
-				Domain: pd.Value,
-			})
+	parsedDomain, err := parseDomainRules(c.Domains)
+	if err != nil {
+		return nil, newError("invalid domain rule").Base(err)
+	}
+
+	for _, pd := range parsedDomain {
+		domains = append(domains, &dns.NameServer_PriorityDomain{
+			Type:   toDomainMatchingType(pd.Type),
+			Domain: pd.Value,
+		})
+	}
+
+	var expectIPs []*router.GeoIP
+	if c.ExpectIPs != nil {
+		if len(c.ExpectIPs) == 0 {
+			return nil, newError("empty expectIps list")
+		}
+		expectIPs, err = toCidrList(c.ExpectIPs)
+		if err != nil {
+			return nil, newError("invalid IP rule in expectIps").Base(err)
 		}
 	}
 
 	return &dns.NameServer{
-		Address: &net.Endpoint{
-			Network: net.Network_UDP,
-			Address: c.Address.Build(),
-			Port:    uint32(c.Port),
-		},
+		Address:           endpoint,
 		PrioritizedDomain: domains,
+		Geoip:             expectIPs,
 	}, nil
 }
 
-var typeMap = map[router.Domain_Type]dns.DomainMatchingType{
-	router.Domain_Full:   dns.DomainMatchingType_Full,
-	router.Domain_Domain: dns.DomainMatchingType_Subdomain,
-	router.Domain_Plain:  dns.DomainMatchingType_Keyword,
-	router.Domain_Regex:  dns.DomainMatchingType_Regex,
+// hostsKeyPrefixes are the prefixes of domain rules accepted in keys of hosts.
+var hostsKeyPrefixes = []string{"domain:", "full:", "regexp:", "keyword:", "geosite:", "ext:", "ruleset:"}
+
+// parseHostsKey parses a key of hosts. It accepts all forms of domain rules, except that a domain without prefix is a full match.
+func parseHostsKey(key string) ([]*router.Domain, error) {
+	idx := strings.Index(key, ":")
+	if idx < 0 {
+		return parseDomainRule("full:" + key)
+	}
+	for _, prefix := range hostsKeyPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return parseDomainRule(key)
+		}
+	}
+	return nil, newError("unknown prefix ", key[:idx+1], " in host ", key)
+}
+
+// normalizeHostsKey returns the canonical form of a key of hosts, so that keys of the same domain rule,
+// such as "example.com" and "full:Example.com", are merged. References to domain lists are returned as is.
+func normalizeHostsKey(key string) (string, error) {
+	if strings.HasPrefix(key, "file:") {
+		return "", newError("hosts file ", key, " must be referenced in the list form of hosts")
+	}
+	for _, prefix := range []string{"geosite:", "ext:", "ruleset:"} {
+		if strings.HasPrefix(key, prefix) {
+			return key, nil
+		}
+	}
+	rules, err := parseHostsKey(key)
+	if err != nil {
+		return "", err
+	}
+	return domainRuleString(rules[0]), nil
 }
 
 // DnsConfig is a JSON serializable object for dns.Config.
 type DnsConfig struct {
-	Servers  []*NameServerConfig `json:"servers"`
-	Hosts    map[string]*Address `json:"hosts"`
-	ClientIP *Address            `json:"clientIp"`
-	Tag      string              `json:"tag"`
+	Servers       []*NameServerConfig `json:"servers"`
+	Hosts         map[string]*Address `json:"hosts"`
+	ClientIP      *Address            `json:"clientIp"`
+	Tag           string              `json:"tag"`
+	FakeDNS       *FakeDNSConfig      `json:"fakedns"`
+	QueryStrategy string              `json:"queryStrategy"`
+	DisableCache  bool                `json:"disableCache"`
+
+	hosts *HostsConfig
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Hosts in JSON may also be a list of static hosts and hosts files,
+// or map a name to multiple IPs. They take precedence over Hosts.
+func (c *DnsConfig) UnmarshalJSON(data []byte) error {
+	type rawDnsConfig DnsConfig
+	config := struct {
+		*rawDnsConfig
+		Hosts *HostsConfig `json:"hosts"`
+	}{
+		rawDnsConfig: (*rawDnsConfig)(c),
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	c.hosts = config.Hosts
+	return nil
+}
+
+// hostsConfig returns Hosts, followed by hosts in JSON.
+func (c *DnsConfig) hostsConfig() *HostsConfig {
+	hosts := new(HostsConfig)
+	if len(c.Hosts) > 0 {
+		layer := &hostsLayer{Hosts: make(map[string]HostAddress, len(c.Hosts))}
+		for key, addr := range c.Hosts {
+			layer.Hosts[key] = HostAddress{addr}
+		}
+		hosts.layers = append(hosts.layers, layer)
+	}
+	if c.hosts != nil {
+		hosts.layers = append(hosts.layers, c.hosts.layers...)
+	}
+	return hosts
+}
+
+// FakeDNSConfig is the pool of fake IPs returned in DNS responses.
+type FakeDNSConfig struct {
+	IPPool      string `json:"ipPool"`
+	PoolSize    int64  `json:"poolSize"`
+	PersistFile string `json:"persistFile"`
+
+	// pool is the parsed IPPool, as it is used by both DNS and routing validation.
+	pool *router.CIDR
 }
 
-func getHostMapping(addr *Address) *dns.Config_HostMapping {
+// localNetworks are the networks that fake IPs must not be allocated from, as they may be real destinations.
+var localNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"255.255.255.255/32",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// Pool returns the CIDR of the fake IP pool. It defaults to 198.18.0.0/15, which is reserved for benchmarking.
+func (c *FakeDNSConfig) Pool() (*router.CIDR, error) {
+	if c.pool != nil {
+		return c.pool, nil
+	}
+	pool := c.IPPool
+	if len(pool) == 0 {
+		pool = "198.18.0.0/15"
+	}
+	if !strings.Contains(pool, "/") {
+		return nil, newError("fake DNS pool must be a CIDR: ", pool)
+	}
+	cidr, err := ParseIP(pool)
+	if err != nil {
+		return nil, newError("invalid fake DNS pool: ", pool).Base(err)
+	}
+	for _, network := range localNetworks {
+		local, err := ParseIP(network)
+		common.Must(err)
+		if cidrOverlaps(cidr, local) {
+			return nil, newError("fake DNS pool ", pool, " overlaps with local network ", network)
+		}
+	}
+	c.pool = cidr
+	return cidr, nil
+}
+
+func (c *FakeDNSConfig) Build() (*fakedns.FakeDnsPool, error) {
+	if len(c.PersistFile) > 0 {
+		return nil, newError("persistFile of fake DNS is not supported, as fake IPs are only kept in memory")
+	}
+	cidr, err := c.Pool()
+	if err != nil {
+		return nil, err
+	}
+
+	size := c.PoolSize
+	if size == 0 {
+		size = 65535
+	}
+	if size < 0 {
+		return nil, newError("invalid fake DNS pool size: ", size)
+	}
+	if hostBits := uint(len(cidr.Ip)*8) - uint(cidr.Prefix); hostBits < 62 && size > int64(1)<<hostBits {
+		return nil, newError("fake DNS pool size ", size, " exceeds the number of addresses in ", cidrString(cidr))
+	}
+
+	return &fakedns.FakeDnsPool{
+		IpPool:  cidrString(cidr),
+		LruSize: size,
+	}, nil
+}
+
+// ValidateRouting returns an error if any CIDR of enabled routing rules overlaps with a part of the fake DNS pool,
+// as connections to fake IPs would be routed by the IPs instead of the domains they stand for. CIDRs that contain
+// the whole pool, such as geoip:private and catch-all CIDRs, only result in a warning.
+func (c *FakeDNSConfig) ValidateRouting(config *RouterConfig) error {
+	routerConfig, origins, err := config.build()
+	if err != nil {
+		return err
+	}
+	return c.validateRouting(config, routerConfig, origins)
+}
+
+// validateRouting checks the routing rules built from config. origins are the indices of the JSON rules
+// that the routing rules come from.
+func (c *FakeDNSConfig) validateRouting(config *RouterConfig, routerConfig *router.Config, origins []int) error {
+	pool, err := c.Pool()
+	if err != nil {
+		return err
+	}
+	rawRules := config.getRuleList()
+	for i, rule := range routerConfig.Rule {
+		var header RouterRule
+		common.Must(json.Unmarshal(rawRules[origins[i]], &header))
+		label := header.label(origins[i])
+
+		cidrs := append(geoipCIDRs(rule.Geoip), rule.Cidr...)
+		warned := false
+		for _, cidr := range cidrs {
+			if !cidrOverlaps(pool, cidr) {
+				continue
+			}
+			if cidr.Prefix >= pool.Prefix {
+				return newError("fake DNS pool ", cidrString(pool), " overlaps with ", cidrString(cidr), " of routing rule ", label)
+			}
+			if !warned {
+				newError("fake DNS pool ", cidrString(pool), " is contained by ", cidrString(cidr), " of routing rule ", label, ", which matches all fake IPs").AtWarning().WriteToLog()
+				warned = true
+			}
+		}
+	}
+	return nil
+}
+
+func (c *DnsConfig) getQueryStrategy() (dns.QueryStrategy, error) {
+	switch strings.ToLower(c.QueryStrategy) {
+	case "", "useip":
+		return dns.QueryStrategy_USE_IP, nil
+	case "useipv4":
+		return dns.QueryStrategy_USE_IP4, nil
+	case "useipv6":
+		return dns.QueryStrategy_USE_IP6, nil
+	default:
+		return dns.QueryStrategy_USE_IP, newError("unknown query strategy: ", c.QueryStrategy)
+	}
+}
+
+// HostAddress is the address of a host. It is either a single address, or a list of IPs.
+type HostAddress []*Address
+
+func (v *HostAddress) UnmarshalJSON(data []byte) error {
+	var addrs []*Address
+	if err := json.Unmarshal(data, &addrs); err == nil {
+		if len(addrs) == 0 {
+			return newError("empty address list of host")
+		}
+		*v = addrs
+		return nil
+	}
+
+	addr := new(Address)
+	if err := json.Unmarshal(data, addr); err != nil {
+		return err
+	}
+	*v = HostAddress{addr}
+	return nil
+}
+
+func (v HostAddress) build() (*dns.Config_HostMapping, error) {
+	if len(v) == 1 {
+		return getHostMapping(v[0])
+	}
+
+	mapping := new(dns.Config_HostMapping)
+	for _, addr := range v {
+		m, err := getHostMapping(addr)
+		if err != nil {
+			return nil, err
+		}
+		if len(m.ProxiedDomain) > 0 {
+			return nil, newError("domain ", m.ProxiedDomain, " can't be used in a list of addresses")
+		}
+		mapping.Ip = append(mapping.Ip, m.Ip...)
+	}
+	return mapping, nil
+}
+
+type hostsLayer struct {
+	File  string
+	Hosts map[string]HostAddress
+}
+
+// HostsConfig is a list of static hosts, and hosts files referenced by "file:/path/to/hosts". Hosts files can only
+// be referenced in the list form. Keys are merged in their canonical form, and if a key appears in more than one
+// item of the list, the last one takes precedence.
+type HostsConfig struct {
+	layers []*hostsLayer
+}
+
+func (c *HostsConfig) UnmarshalJSON(data []byte) error {
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '{' {
+		var hosts map[string]HostAddress
+		if err := json.Unmarshal(data, &hosts); err != nil {
+			return newError("invalid hosts: ", string(data)).Base(err)
+		}
+		c.layers = []*hostsLayer{{Hosts: hosts}}
+		return nil
+	}
+
+	var list []json.RawMessage
+	if err := json.Unmarshal(data, &list); err != nil {
+		return newError("invalid hosts: ", string(data)).Base(err)
+	}
+	c.layers = make([]*hostsLayer, 0, len(list))
+	for _, item := range list {
+		var file string
+		if err := json.Unmarshal(item, &file); err == nil {
+			if !strings.HasPrefix(file, "file:") || len(file) == 5 {
+				return newError("invalid hosts file reference: ", file)
+			}
+			c.layers = append(c.layers, &hostsLayer{File: file[5:]})
+			continue
+		}
+		var hosts map[string]HostAddress
+		if err := json.Unmarshal(item, &hosts); err != nil {
+			return newError("invalid hosts: ", string(item)).Base(err)
+		}
+		c.layers = append(c.layers, &hostsLayer{Hosts: hosts})
+	}
+	return nil
+}
+
+// parseHostsFile parses content in the format of /etc/hosts. A name that appears in multiple lines maps to all of their IPs.
+func parseHostsFile(content []byte) (map[string]*dns.Config_HostMapping, error) {
+	hosts := make(map[string]*dns.Config_HostMapping)
+	for lineNum, line := range strings.Split(string(content), "\n") {
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, newError("no host name at line ", lineNum+1)
+		}
+
+		ipStr := fields[0]
+		if idx := strings.IndexByte(ipStr, '%'); idx >= 0 {
+			ipStr = ipStr[:idx]
+		}
+		ip := net.ParseAddress(ipStr)
+		if !ip.Family().IsIP() {
+			return nil, newError("invalid IP ", fields[0], " at line ", lineNum+1)
+		}
+
+		for _, name := range fields[1:] {
+			domain, err := normalizeDomain(name)
+			if err != nil {
+				return nil, newError("invalid host name at line ", lineNum+1).Base(err)
+			}
+			mapping, found := hosts[domain]
+			if !found {
+				mapping = new(dns.Config_HostMapping)
+				hosts[domain] = mapping
+			}
+			duplicated := false
+			for _, existing := range mapping.Ip {
+				if bytes.Equal(existing, ip.IP()) {
+					duplicated = true
+					break
+				}
+			}
+			if !duplicated {
+				mapping.Ip = append(mapping.Ip, []byte(ip.IP()))
+			}
+		}
+	}
+	return hosts, nil
+}
+
+// Build merges all static hosts and hosts files, and returns the mapping of each host key in its canonical form.
+func (c *HostsConfig) Build() (map[string]*dns.Config_HostMapping, error) {
+	merged := make(map[string]*dns.Config_HostMapping)
+	for _, layer := range c.layers {
+		if len(layer.File) > 0 {
+			content, err := sysio.ReadFile(layer.File)
+			if err != nil {
+				return nil, newError("failed to read hosts file ", layer.File).Base(err)
+			}
+			hosts, err := parseHostsFile(content)
+			if err != nil {
+				return nil, newError("invalid hosts file ", layer.File).Base(err)
+			}
+			for name, mapping := range hosts {
+				merged["full:"+name] = mapping
+			}
+			continue
+		}
+		keys := make(map[string]string, len(layer.Hosts))
+		for key, addr := range layer.Hosts {
+			normalized, err := normalizeHostsKey(key)
+			if err != nil {
+				return nil, newError("invalid host ", key).Base(err)
+			}
+			if existing, found := keys[normalized]; found {
+				return nil, newError("host ", key, " duplicates ", existing)
+			}
+			keys[normalized] = key
+			mapping, err := addr.build()
+			if err != nil {
+				return nil, newError("invalid address of host ", key).Base(err)
+			}
+			merged[normalized] = mapping
+		}
+	}
+	return merged, nil
+}
+
+// maxHostRangeSize is the maximum number of IPs that an IP range in hosts can expand to.
+const maxHostRangeSize = 256
+
+// expandIPRange returns all IPs in an IP range in the form of "start-end".
+func expandIPRange(s string) ([][]byte, error) {
+	start, end, err := parseIPRangeBounds(s)
+	if err != nil {
+		return nil, err
+	}
+	current := new(big.Int).SetBytes(start)
+	last := new(big.Int).SetBytes(end)
+	one := big.NewInt(1)
+
+	var ips [][]byte
+	for ; current.Cmp(last) <= 0; current.Add(current, one) {
+		if len(ips) >= maxHostRangeSize {
+			return nil, newError("IP range ", s, " contains more than ", maxHostRangeSize, " addresses")
+		}
+		ip := make([]byte, len(start))
+		b := current.Bytes()
+		copy(ip[len(ip)-len(b):], b)
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func getHostMapping(addr *Address) (*dns.Config_HostMapping, error) {
 	if addr.Family().IsIP() {
 		return &dns.Config_HostMapping{
 			Ip: [][]byte{[]byte(addr.IP())},
+		}, nil
+	}
+
+	domain := addr.Domain()
+	if strings.Contains(domain, "/") {
+		return nil, newError("CIDR is not allowed in hosts: ", domain)
+	}
+	if i := strings.Index(domain, "-"); i > 0 && net.ParseAddress(domain[:i]).Family().IsIP() {
+		ips, err := expandIPRange(domain)
+		if err != nil {
+			return nil, newError("invalid IP range in hosts: ", domain).Base(err)
 		}
-	} else {
 		return &dns.Config_HostMapping{
-			ProxiedDomain: addr.Domain(),
-		}
+			Ip: ips,
+		}, nil
 	}
+	return &dns.Config_HostMapping{
+		ProxiedDomain: domain,
+	}, nil
 }
 
 // Build implements Buildable
 func (c *DnsConfig) Build() (*dns.Config, error) {
+	queryStrategy, err := c.getQueryStrategy()
+	if err != nil {
+		return nil, err
+	}
 	config := &dns.Config{
-		Tag: c.Tag,
+		Tag:           c.Tag,
+		QueryStrategy: queryStrategy,
+		DisableCache:  c.DisableCache,
+	}
+
+	if c.FakeDNS != nil {
+		if _, err := c.FakeDNS.Build(); err != nil {
+			return nil, err
+		}
+		pool, err := c.FakeDNS.Pool()
+		if err != nil {
+			return nil, err
+		}
+		isIPv4 := len(pool.Ip) == stdnet.IPv4len
+		if (isIPv4 && queryStrategy == dns.QueryStrategy_USE_IP6) || (!isIPv4 && queryStrategy == dns.QueryStrategy_USE_IP4) {
+			return nil, newError("fake DNS pool ", cidrString(pool), " doesn't match query strategy ", c.QueryStrategy)
+		}
 	}
 
 	if c.ClientIP != nil {
@@ -133,44 +699,38 @@ func (c *DnsConfig) Build() (*dns.Config, error) {
 		config.NameServer = append(config.NameServer, ns)
 	}
 
-	if c.Hosts != nil && len(c.Hosts) > 0 {
-		domains := make([]string, 0, len(c.Hosts))
-		for domain := range c.Hosts {
+	if len(c.Hosts) > 0 || c.hosts != nil {
+		hosts, err := c.hostsConfig().Build()
+		if err != nil {
+			return nil, err
+		}
+		domains := make([]string, 0, len(hosts))
+		for domain := range hosts {
 			domains = append(domains, domain)
 		}
 		sort.Strings(domains)
 		for _, domain := range domains {
-			addr := c.Hosts[domain]
-			var mappings []*dns.Config_HostMapping
-			if strings.HasPrefix(domain, "domain:") {
-				mapping := getHostMapping(addr)
-				mapping.Type = dns.DomainMatchingType_Subdomain
-				mapping.Domain = domain[7:]
-
-				mappings = append(mappings, mapping)
-			} else if strings.HasPrefix(domain, "geosite:") {
-				domains, err := loadGeositeWithAttr("geosite.dat", strings.ToUpper(domain[8:]))
-				if err != nil {
-					return nil, newError("invalid geosite settings: ", domain).Base(err)
+			hostMapping := hosts[domain]
+			newMapping := func(t dns.DomainMatchingType, d string) *dns.Config_HostMapping {
+				return &dns.Config_HostMapping{
+					Type:          t,
+					Domain:        d,
+					Ip:            hostMapping.Ip,
+					ProxiedDomain: hostMapping.ProxiedDomain,
 				}
-				for _, d := range domains {
-					mapping := getHostMapping(addr)
-					mapping.Type = typeMap[d.Type]
-					mapping.Domain = d.Value
-
-					mappings = append(mappings, mapping)
-				}
-			} else {
-				mapping := getHostMapping(addr)
-				mapping.Type = dns.DomainMatchingType_Full
-				mapping.Domain = domain
-
-				mappings = append(mappings, mapping)
 			}
 
-			config.StaticHosts = append(config.StaticHosts, mappings...)
+			rules, err := parseHostsKey(domain)
+			if err != nil {
+				return nil, newError("invalid host ", domain).Base(err)
+			}
+			for _, d := range rules {
+				config.StaticHosts = append(config.StaticHosts, newMapping(toDomainMatchingType(d.Type), d.Value))
+			}
 		}
 	}
 
+	optimizeDnsConfig(config)
+
 	return config, nil
 }
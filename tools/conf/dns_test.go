@@ -2,12 +2,15 @@ package conf_test
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/golang/protobuf/proto"
 	"v2ray.com/core/app/dns"
+	"v2ray.com/core/app/router"
 	"v2ray.com/core/common"
 	"v2ray.com/core/common/net"
 	"v2ray.com/core/common/platform"
@@ -43,7 +46,12 @@ func TestDnsConfigParsing(t *testing.T) {
 				"hosts": {
 					"v2ray.com": "127.0.0.1",
 					"geosite:tld-cn": "10.0.0.1",
-					"domain:example.com": "google.com"
+					"domain:example.com": "google.com",
+					"range.v2ray.com": "10.0.0.1-10.0.0.2",
+					"ext:geosite.dat:tld-cn": "10.0.0.2",
+					"keyword:CDN": "10.0.0.3",
+					"regexp:^api\\.": "10.0.0.4",
+					"full:WWW.V2Ray.com": "10.0.0.5"
 				},
 				"clientIp": "10.0.0.1"
 			}`,
@@ -74,6 +82,31 @@ func TestDnsConfigParsing(t *testing.T) {
 						Domain:        "example.com",
 						ProxiedDomain: "google.com",
 					},
+					{
+						Type:   dns.DomainMatchingType_Subdomain,
+						Domain: "cn",
+						Ip:     [][]byte{{10, 0, 0, 2}},
+					},
+					{
+						Type:   dns.DomainMatchingType_Subdomain,
+						Domain: "xn--fiqs8s",
+						Ip:     [][]byte{{10, 0, 0, 2}},
+					},
+					{
+						Type:   dns.DomainMatchingType_Full,
+						Domain: "range.v2ray.com",
+						Ip:     [][]byte{{10, 0, 0, 1}, {10, 0, 0, 2}},
+					},
+					{
+						Type:   dns.DomainMatchingType_Full,
+						Domain: "v2ray.com",
+						Ip:     [][]byte{{127, 0, 0, 1}},
+					},
+					{
+						Type:   dns.DomainMatchingType_Full,
+						Domain: "www.v2ray.com",
+						Ip:     [][]byte{{10, 0, 0, 5}},
+					},
 					{
 						Type:   dns.DomainMatchingType_Subdomain,
 						Domain: "cn",
@@ -84,14 +117,436 @@ func TestDnsConfigParsing(t *testing.T) {
 						Domain: "xn--fiqs8s",
 						Ip:     [][]byte{{10, 0, 0, 1}},
 					},
+					{
+						Type:   dns.DomainMatchingType_Keyword,
+						Domain: "cdn",
+						Ip:     [][]byte{{10, 0, 0, 3}},
+					},
+					{
+						Type:   dns.DomainMatchingType_Regex,
+						Domain: "^api\\.",
+						Ip:     [][]byte{{10, 0, 0, 4}},
+					},
+				},
+				ClientIp: []byte{10, 0, 0, 1},
+			},
+		},
+		{
+			Input:  `{"hosts": {"foo:bar": "127.0.0.1"}}`,
+			Parser: parserCreator(),
+			Error:  "unknown prefix foo: in host foo:bar",
+		},
+	})
+}
+
+func TestNameServerURL(t *testing.T) {
+	parser := func(s string) (proto.Message, error) {
+		config := new(NameServerConfig)
+		if err := json.Unmarshal([]byte(s), config); err != nil {
+			return nil, err
+		}
+		return config.Build()
+	}
+
+	runMultiTestCase(t, []TestCase{
+		{
+			Input:  `"https://1.1.1.1/dns-query"`,
+			Parser: parser,
+			Output: &dns.NameServer{
+				Address: &net.Endpoint{
+					Network: net.Network_TCP,
+					Address: net.NewIPOrDomain(net.DomainAddress("https://1.1.1.1:443/dns-query")),
+					Port:    443,
+				},
+			},
+		},
+		{
+			Input:  `"https://[2606:4700::1111]/dns-query"`,
+			Parser: parser,
+			Output: &dns.NameServer{
+				Address: &net.Endpoint{
+					Network: net.Network_TCP,
+					Address: net.NewIPOrDomain(net.DomainAddress("https://[2606:4700::1111]:443/dns-query")),
+					Port:    443,
+				},
+			},
+		},
+		{
+			Input:  `"https+local://DNS.Google:8443/resolve"`,
+			Parser: parser,
+			Output: &dns.NameServer{
+				Address: &net.Endpoint{
+					Network: net.Network_TCP,
+					Address: net.NewIPOrDomain(net.DomainAddress("https+local://dns.google:8443/resolve")),
+					Port:    8443,
+				},
+			},
+		},
+		{
+			Input:  `"udp://8.8.8.8"`,
+			Parser: parser,
+			Output: &dns.NameServer{
+				Address: &net.Endpoint{
+					Network: net.Network_UDP,
+					Address: net.NewIPOrDomain(net.ParseAddress("8.8.8.8")),
+					Port:    53,
+				},
+			},
+		},
+		{
+			Input: `{
+				"address": "udp://[2001:4860:4860::8888]:5353",
+				"domains": ["domain:v2ray.com"]
+			}`,
+			Parser: parser,
+			Output: &dns.NameServer{
+				Address: &net.Endpoint{
+					Network: net.Network_UDP,
+					Address: net.NewIPOrDomain(net.ParseAddress("2001:4860:4860::8888")),
+					Port:    5353,
+				},
+				PrioritizedDomain: []*dns.NameServer_PriorityDomain{
+					{
+						Type:   dns.DomainMatchingType_Subdomain,
+						Domain: "v2ray.com",
+					},
+				},
+			},
+		},
+		{
+			Input:  `"tls://dns.example:853"`,
+			Parser: parser,
+			Error:  "DNS over TLS is unsupported",
+		},
+		{
+			Input:  `"tcp://8.8.8.8:53"`,
+			Parser: parser,
+			Error:  "DNS over TCP is unsupported",
+		},
+		{
+			Input:  `"quic://1.1.1.1"`,
+			Parser: parser,
+			Error:  "unsupported scheme of name server",
+		},
+		{
+			Input:  `"https://1.1.1.1"`,
+			Parser: parser,
+			Error:  "path of DNS over HTTPS server is not specified",
+		},
+		{
+			Input:  `"https://1.1.1.1/dns-query?name=a"`,
+			Parser: parser,
+			Error:  "query is not allowed",
+		},
+		{
+			Input:  `"udp://8.8.8.8:53/path"`,
+			Parser: parser,
+			Error:  "path and query are not allowed",
+		},
+		{
+			Input:  `"udp://8.8.8.8:65536"`,
+			Parser: parser,
+			Error:  "invalid port",
+		},
+		{
+			Input:  `"udp://:53"`,
+			Parser: parser,
+			Error:  "empty host",
+		},
+		{
+			Input:  `"udp://bad_host!:53"`,
+			Parser: parser,
+			Error:  "invalid host",
+		},
+	})
+}
+
+func TestDnsHostsFile(t *testing.T) {
+	hostsFile, err := ioutil.TempFile("", "hosts")
+	common.Must(err)
+	defer os.Remove(hostsFile.Name())
+	common.Must2(hostsFile.WriteString(`
+# internal services
+10.0.0.1    db.internal   cache.internal # trailing comment
+2001:db8::1 db.internal
+10.0.0.2    web.internal
+`))
+	common.Must(hostsFile.Close())
+
+	parser := func(s string) (proto.Message, error) {
+		config := new(DnsConfig)
+		if err := json.Unmarshal([]byte(s), config); err != nil {
+			return nil, err
+		}
+		return config.Build()
+	}
+
+	runMultiTestCase(t, []TestCase{
+		{
+			Input: `{
+				"hosts": [
+					"file:` + filepath.ToSlash(hostsFile.Name()) + `",
+					{
+						"web.internal": ["10.0.1.1", "10.0.1.2"],
+						"domain:v2ray.com": "127.0.0.1"
+					}
+				]
+			}`,
+			Parser: parser,
+			Output: &dns.Config{
+				StaticHosts: []*dns.Config_HostMapping{
+					{
+						Type:   dns.DomainMatchingType_Full,
+						Domain: "cache.internal",
+						Ip:     [][]byte{{10, 0, 0, 1}},
+					},
 					{
 						Type:   dns.DomainMatchingType_Full,
+						Domain: "db.internal",
+						Ip:     [][]byte{{10, 0, 0, 1}, {0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+					},
+					{
+						Type:   dns.DomainMatchingType_Subdomain,
 						Domain: "v2ray.com",
 						Ip:     [][]byte{{127, 0, 0, 1}},
 					},
+					{
+						Type:   dns.DomainMatchingType_Full,
+						Domain: "web.internal",
+						Ip:     [][]byte{{10, 0, 1, 1}, {10, 0, 1, 2}},
+					},
 				},
-				ClientIp: []byte{10, 0, 0, 1},
+			},
+		},
+		{
+			Input: `{
+				"hosts": [
+					"file:` + filepath.ToSlash(hostsFile.Name()) + `",
+					{"full:Web.Internal": "10.0.1.1"}
+				]
+			}`,
+			Parser: parser,
+			Output: &dns.Config{
+				StaticHosts: []*dns.Config_HostMapping{
+					{
+						Type:   dns.DomainMatchingType_Full,
+						Domain: "cache.internal",
+						Ip:     [][]byte{{10, 0, 0, 1}},
+					},
+					{
+						Type:   dns.DomainMatchingType_Full,
+						Domain: "db.internal",
+						Ip:     [][]byte{{10, 0, 0, 1}, {0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+					},
+					{
+						Type:   dns.DomainMatchingType_Full,
+						Domain: "web.internal",
+						Ip:     [][]byte{{10, 0, 1, 1}},
+					},
+				},
+			},
+		},
+		{
+			Input:  `{"hosts": ["/etc/hosts"]}`,
+			Parser: parser,
+			Error:  "invalid hosts file reference",
+		},
+		{
+			Input:  `{"hosts": {"file:/etc/hosts": "127.0.0.1"}}`,
+			Parser: parser,
+			Error:  "must be referenced in the list form of hosts",
+		},
+		{
+			Input:  `{"hosts": {"v2ray.com": "127.0.0.1", "full:V2Ray.com": "127.0.0.2"}}`,
+			Parser: parser,
+			Error:  "duplicates",
+		},
+		{
+			Input:  `{"hosts": {"v2ray.com": ["10.0.0.1", "google.com"]}}`,
+			Parser: parser,
+			Error:  "can't be used in a list of addresses",
+		},
+		{
+			Input:  `{"hosts": {"v2ray.com": []}}`,
+			Parser: parser,
+			Error:  "empty address list of host",
+		},
+	})
+
+	config := &DnsConfig{
+		Hosts: map[string]*Address{
+			"v2ray.com": {Address: net.ParseAddress("127.0.0.1")},
+		},
+	}
+	pbConfig, err := config.Build()
+	common.Must(err)
+	expected := []*dns.Config_HostMapping{
+		{
+			Type:   dns.DomainMatchingType_Full,
+			Domain: "v2ray.com",
+			Ip:     [][]byte{{127, 0, 0, 1}},
+		},
+	}
+	if len(pbConfig.StaticHosts) != 1 || !proto.Equal(pbConfig.StaticHosts[0], expected[0]) {
+		t.Error("unexpected static hosts: ", pbConfig.StaticHosts)
+	}
+}
+
+func TestNameServerExpectIPs(t *testing.T) {
+	parser := func(s string) (proto.Message, error) {
+		config := new(NameServerConfig)
+		if err := json.Unmarshal([]byte(s), config); err != nil {
+			return nil, err
+		}
+		return config.Build()
+	}
+
+	runMultiTestCase(t, []TestCase{
+		{
+			Input: `{
+				"address": "114.114.114.114",
+				"port": 53,
+				"expectIps": ["10.0.0.0/8", "192.168.0.0/16", "!10.1.0.0/16"]
+			}`,
+			Parser: parser,
+			Output: &dns.NameServer{
+				Address: &net.Endpoint{
+					Network: net.Network_UDP,
+					Address: net.NewIPOrDomain(net.ParseAddress("114.114.114.114")),
+					Port:    53,
+				},
+				Geoip: []*router.GeoIP{
+					{
+						Cidr: []*router.CIDR{
+							{Ip: []byte{10, 0, 0, 0}, Prefix: 16},
+							{Ip: []byte{10, 2, 0, 0}, Prefix: 15},
+							{Ip: []byte{10, 4, 0, 0}, Prefix: 14},
+							{Ip: []byte{10, 8, 0, 0}, Prefix: 13},
+							{Ip: []byte{10, 16, 0, 0}, Prefix: 12},
+							{Ip: []byte{10, 32, 0, 0}, Prefix: 11},
+							{Ip: []byte{10, 64, 0, 0}, Prefix: 10},
+							{Ip: []byte{10, 128, 0, 0}, Prefix: 9},
+							{Ip: []byte{192, 168, 0, 0}, Prefix: 16},
+						},
+					},
+				},
+			},
+		},
+		{
+			Input:  `{"address": "8.8.8.8", "expectIps": []}`,
+			Parser: parser,
+			Error:  "empty expectIps list",
+		},
+		{
+			Input:  `{"address": "8.8.8.8", "expectIps": ["10.0.0.1/8"]}`,
+			Parser: parser,
+			Error:  "host bits are set",
+		},
+		{
+			Input:  `{"address": "8.8.8.8", "expectIps": ["!0.0.0.0/0", "!::/0"]}`,
+			Parser: parser,
+			Error:  "no IP left after applying exclusions",
+		},
+	})
+}
+
+func TestFakeDNSConfig(t *testing.T) {
+	parser := func(s string) (proto.Message, error) {
+		config := new(DnsConfig)
+		if err := json.Unmarshal([]byte(s), config); err != nil {
+			return nil, err
+		}
+		return config.Build()
+	}
+
+	runMultiTestCase(t, []TestCase{
+		{
+			Input: `{
+				"fakedns": {},
+				"queryStrategy": "UseIPv4",
+				"disableCache": true
+			}`,
+			Parser: parser,
+			Output: &dns.Config{
+				QueryStrategy: dns.QueryStrategy_USE_IP4,
+				DisableCache:  true,
 			},
 		},
 	})
+
+	fakeDNS := &FakeDNSConfig{
+		IPPool:   "198.18.0.0/16",
+		PoolSize: 1024,
+	}
+	pool, err := fakeDNS.Build()
+	common.Must(err)
+	if pool.IpPool != "198.18.0.0/16" || pool.LruSize != 1024 {
+		t.Error("unexpected fake DNS pool: ", pool)
+	}
+
+	routerConfig := new(RouterConfig)
+	common.Must(json.Unmarshal([]byte(`{
+		"rules": [
+			{"type": "field", "ip": ["!10.0.0.0/8"], "outboundTag": "direct"},
+			{"type": "field", "ip": ["0.0.0.0/0", "::/0"], "outboundTag": "direct"},
+			{"type": "field", "ip": ["198.18.0.0/24"], "outboundTag": "direct", "enabled": false}
+		]
+	}`), routerConfig))
+	common.Must(fakeDNS.ValidateRouting(routerConfig))
+
+	routerConfig = new(RouterConfig)
+	common.Must(json.Unmarshal([]byte(`{
+		"rules": [
+			{"type": "field", "ip": ["198.18.0.0/24"], "outboundTag": "direct", "name": "lab"}
+		]
+	}`), routerConfig))
+	if err := fakeDNS.ValidateRouting(routerConfig); err == nil || !strings.Contains(err.Error(), "overlaps with 198.18.0.0/24 of routing rule 0 (lab)") {
+		t.Error("expected error for overlapping routing rule, but got ", err)
+	}
+
+	routerConfig = new(RouterConfig)
+	common.Must(json.Unmarshal([]byte(`{
+		"rules": [
+			{"type": "field", "ip": ["!198.18.0.0/17"], "outboundTag": "direct"}
+		]
+	}`), routerConfig))
+	if err := fakeDNS.ValidateRouting(routerConfig); err == nil || !strings.Contains(err.Error(), "overlaps with 198.18.128.0/17 of routing rule 0") {
+		t.Error("expected error for overlapping exclusion, but got ", err)
+	}
+
+	runMultiTestCase(t, []TestCase{
+		{
+			Input:  `{"fakedns": {"ipPool": "10.1.0.0/16"}}`,
+			Parser: parser,
+			Error:  "overlaps with local network 10.0.0.0/8",
+		},
+		{
+			Input:  `{"fakedns": {"ipPool": "198.18.0.1"}}`,
+			Parser: parser,
+			Error:  "fake DNS pool must be a CIDR",
+		},
+		{
+			Input:  `{"fakedns": {"ipPool": "198.18.0.0/15"}, "queryStrategy": "UseIPv6"}`,
+			Parser: parser,
+			Error:  "doesn't match query strategy",
+		},
+		{
+			Input:  `{"queryStrategy": "UseIPv5"}`,
+			Parser: parser,
+			Error:  "unknown query strategy",
+		},
+	})
+
+	for _, testCase := range []struct {
+		config *FakeDNSConfig
+		err    string
+	}{
+		{&FakeDNSConfig{IPPool: "198.18.0.0/24", PoolSize: 1024}, "exceeds the number of addresses"},
+		{&FakeDNSConfig{PoolSize: -1}, "invalid fake DNS pool size"},
+		{&FakeDNSConfig{PersistFile: "fakedns.dat"}, "persistFile of fake DNS is not supported"},
+	} {
+		if _, err := testCase.config.Build(); err == nil || !strings.Contains(err.Error(), testCase.err) {
+			t.Error("expected error ", testCase.err, ", but got ", err)
+		}
+	}
 }
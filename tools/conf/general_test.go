@@ -2,6 +2,7 @@ package conf_test
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/golang/protobuf/proto"
@@ -23,11 +24,19 @@ type TestCase struct {
 	Input  string
 	Parser func(string) (proto.Message, error)
 	Output proto.Message
+	// Error is a part of the expected error message. If it is not empty, parsing Input must fail with it.
+	Error string
 }
 
 func runMultiTestCase(t *testing.T, testCases []TestCase) {
 	for _, testCase := range testCases {
 		actual, err := testCase.Parser(testCase.Input)
+		if len(testCase.Error) > 0 {
+			if err == nil || !strings.Contains(err.Error(), testCase.Error) {
+				t.Errorf("Failed in test case:\n%s\nActual error:\n%v\nExpected error:\n%s", testCase.Input, err, testCase.Error)
+			}
+			continue
+		}
 		common.Must(err)
 		if !proto.Equal(actual, testCase.Output) {
 			t.Fatalf("Failed in test case:\n%s\nActual:\n%v\nExpected:\n%v", testCase.Input, actual, testCase.Output)
@@ -0,0 +1,316 @@
+package conf
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"v2ray.com/core/common"
+	"v2ray.com/core/common/platform"
+	"v2ray.com/ext/sysio"
+)
+
+// HTTPPresetFile is the JSON file of user defined HTTP header presets, in the form of {"name": {"request": {...}, "response": {...}}}.
+// It can be changed by environment variable V2RAY_HTTP_PRESETS. User defined presets override built-in ones of the same name.
+var HTTPPresetFile = platform.NewEnvFlag("v2ray.http.presets").GetValue(func() string {
+	return platform.GetAssetLocation("http_presets.json")
+})
+
+// builtinHTTPPresets are the built-in HTTP header presets. A value list of a header, or the path list, is picked
+// randomly for each connection.
+const builtinHTTPPresets = `{
+	"default": {
+		"request": {
+			"version": "1.1",
+			"method": "GET",
+			"path": ["/"],
+			"headers": {
+				"Host": ["www.baidu.com", "www.bing.com"],
+				"User-Agent": [
+					"Mozilla/5.0 (Windows NT 10.0; WOW64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/53.0.2785.143 Safari/537.36",
+					"Mozilla/5.0 (iPhone; CPU iPhone OS 10_0_2 like Mac OS X) AppleWebKit/601.1 (KHTML, like Gecko) CriOS/53.0.2785.109 Mobile/14A456 Safari/601.1.46"
+				],
+				"Accept-Encoding": ["gzip, deflate"],
+				"Connection": ["keep-alive"],
+				"Pragma": ["no-cache"]
+			}
+		},
+		"response": {
+			"version": "1.1",
+			"status": "200",
+			"reason": "OK",
+			"headers": {
+				"Content-Type": ["application/octet-stream", "video/mpeg"],
+				"Transfer-Encoding": ["chunked"],
+				"Connection": ["keep-alive"],
+				"Pragma": ["no-cache"],
+				"Cache-Control": ["private", "no-cache"]
+			}
+		}
+	},
+	"browser": {
+		"request": {
+			"version": "1.1",
+			"method": "GET",
+			"path": ["/", "/index.html", "/search", "/news", "/static/js/main.js", "/static/css/main.css"],
+			"headers": {
+				"Host": ["www.bing.com", "www.wikipedia.org", "www.cloudflare.com"],
+				"User-Agent": [
+					"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/78.0.3904.108 Safari/537.36",
+					"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_1) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/78.0.3904.108 Safari/537.36",
+					"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:70.0) Gecko/20100101 Firefox/70.0",
+					"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_1) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.0.3 Safari/605.1.15"
+				],
+				"Accept": ["text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,*/*;q=0.8"],
+				"Accept-Language": ["en-US,en;q=0.9", "en-GB,en;q=0.8", "zh-CN,zh;q=0.9,en;q=0.8"],
+				"Accept-Encoding": ["gzip, deflate"],
+				"Connection": ["keep-alive"],
+				"Cache-Control": ["max-age=0", "no-cache"]
+			}
+		},
+		"response": {
+			"version": "1.1",
+			"status": "200",
+			"reason": "OK",
+			"headers": {
+				"Content-Type": ["text/html; charset=utf-8", "application/javascript", "text/css"],
+				"Transfer-Encoding": ["chunked"],
+				"Connection": ["keep-alive"],
+				"Cache-Control": ["private, max-age=0", "no-cache"],
+				"Vary": ["Accept-Encoding"]
+			}
+		}
+	},
+	"video": {
+		"request": {
+			"version": "1.1",
+			"method": "GET",
+			"path": ["/video/720p/segment.ts", "/video/1080p/segment.ts", "/hls/live.m3u8", "/dash/video.mp4"],
+			"headers": {
+				"Host": ["video.twimg.com", "v.redd.it"],
+				"User-Agent": [
+					"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/78.0.3904.108 Safari/537.36",
+					"Mozilla/5.0 (iPhone; CPU iPhone OS 13_2_3 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.0.3 Mobile/15E148 Safari/604.1"
+				],
+				"Accept": ["*/*"],
+				"Accept-Encoding": ["identity"],
+				"Connection": ["keep-alive"]
+			}
+		},
+		"response": {
+			"version": "1.1",
+			"status": "200",
+			"reason": "OK",
+			"headers": {
+				"Content-Type": ["video/mp2t", "video/mp4", "application/vnd.apple.mpegurl"],
+				"Transfer-Encoding": ["chunked"],
+				"Connection": ["keep-alive"],
+				"Accept-Ranges": ["bytes"],
+				"Cache-Control": ["public, max-age=3600"]
+			}
+		}
+	},
+	"download": {
+		"request": {
+			"version": "1.1",
+			"method": "GET",
+			"path": ["/download/setup.exe", "/files/update.zip", "/pub/archive.tar.gz"],
+			"headers": {
+				"Host": ["download.microsoft.com", "dl.google.com", "mirrors.kernel.org"],
+				"User-Agent": ["Wget/1.20.3 (linux-gnu)", "curl/7.67.0", "Microsoft BITS/7.8"],
+				"Accept": ["*/*"],
+				"Connection": ["keep-alive"]
+			}
+		},
+		"response": {
+			"version": "1.1",
+			"status": "200",
+			"reason": "OK",
+			"headers": {
+				"Content-Type": ["application/octet-stream", "application/zip", "application/x-gzip"],
+				"Transfer-Encoding": ["chunked"],
+				"Connection": ["keep-alive"],
+				"Accept-Ranges": ["bytes"]
+			}
+		}
+	}
+}`
+
+func parseHTTPPresets(data []byte) (map[string]*HTTPAuthenticator, error) {
+	var presets map[string]*HTTPAuthenticator
+	if err := json.Unmarshal(data, &presets); err != nil {
+		return nil, err
+	}
+	for name, preset := range presets {
+		if preset == nil {
+			return nil, newError("empty HTTP header preset: ", name)
+		}
+		if len(preset.Preset) > 0 {
+			return nil, newError("HTTP header preset ", name, " can't reference another preset")
+		}
+	}
+	return presets, nil
+}
+
+// builtinHTTPPresetMap is builtinHTTPPresets parsed. The presets must not be modified.
+var builtinHTTPPresetMap = func() map[string]*HTTPAuthenticator {
+	presets, err := parseHTTPPresets([]byte(builtinHTTPPresets))
+	common.Must(err)
+	return presets
+}()
+
+// loadHTTPPreset returns the preset of the given name. Presets in HTTPPresetFile take precedence over built-in ones.
+func loadHTTPPreset(name string) (*HTTPAuthenticator, error) {
+	data, err := sysio.ReadFile(HTTPPresetFile)
+	switch {
+	case err == nil:
+		presets, err := parseHTTPPresets(data)
+		if err != nil {
+			return nil, newError("failed to parse HTTP header presets in ", HTTPPresetFile).Base(err)
+		}
+		if preset, found := presets[name]; found {
+			return preset, nil
+		}
+	case !os.IsNotExist(err):
+		return nil, newError("failed to read HTTP header presets in ", HTTPPresetFile).Base(err)
+	}
+
+	if preset, found := builtinHTTPPresetMap[name]; found {
+		return preset, nil
+	}
+	return nil, newError("HTTP header preset not found: ", name)
+}
+
+// mergeHTTPHeaders returns the headers of base with those in override added. Header names are case-insensitive.
+func mergeHTTPHeaders(base, override map[string]*StringList) map[string]*StringList {
+	merged := make(map[string]*StringList, len(base)+len(override))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range override {
+		for existing := range merged {
+			if strings.EqualFold(existing, key) {
+				delete(merged, existing)
+			}
+		}
+		merged[key] = value
+	}
+	return merged
+}
+
+// isHTTPToken returns true if s is a token in RFC 7230.
+func isHTTPToken(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isHTTPFieldValue returns true if s contains no control characters other than horizontal tab.
+func isHTTPFieldValue(s string) bool {
+	for _, c := range s {
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// isHTTPVersion returns true if s is an HTTP version in the form of "1.1".
+func isHTTPVersion(s string) bool {
+	return len(s) == 3 && isDigit(s[0]) && s[1] == '.' && isDigit(s[2])
+}
+
+// isHTTPStatusCode returns true if s is a status code of three digits.
+func isHTTPStatusCode(s string) bool {
+	return len(s) == 3 && isDigit(s[0]) && isDigit(s[1]) && isDigit(s[2])
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isHTTPLineField returns true if s can be written as a field of the start line of an HTTP message, that is, it is
+// not empty and contains no whitespace or control characters.
+func isHTTPLineField(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, c := range s {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeHTTPPath returns path with a leading "/" if it is missing. Request targets in absolute form, such as
+// "http://www.v2ray.com/", are returned as is.
+func normalizeHTTPPath(path string) (string, error) {
+	lower := strings.ToLower(path)
+	if !strings.HasPrefix(path, "/") && !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") {
+		path = "/" + path
+	}
+	if !isHTTPLineField(path) {
+		return "", newError("invalid character in HTTP path: ", path)
+	}
+	return path, nil
+}
+
+func validateHTTPHeader(name string, values []string) error {
+	if !isHTTPToken(name) {
+		return newError("invalid HTTP header name: ", name)
+	}
+	for _, value := range values {
+		if !isHTTPFieldValue(value) {
+			return newError("invalid value of HTTP header ", name, ": ", value)
+		}
+	}
+	return nil
+}
+
+// checkHTTPHeader returns an error if the header can't be written without breaking the HTTP message.
+// Unlike validateHTTPHeader, it accepts names that are not tokens, as some disguises need them.
+func checkHTTPHeader(name string, values []string) error {
+	if len(name) == 0 || !isHTTPFieldValue(name) || strings.ContainsAny(name, ":\t") {
+		return newError("invalid HTTP header name: ", name)
+	}
+	for _, value := range values {
+		if !isHTTPFieldValue(value) {
+			return newError("invalid value of HTTP header ", name, ": ", value)
+		}
+	}
+	return nil
+}
+
+// normalizeHTTPHost validates a host in the form of host[:port], and returns it with the domain name normalized.
+func normalizeHTTPHost(host string) (string, error) {
+	name, port := host, ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		if _, err := strconv.ParseUint(p, 10, 16); err != nil {
+			return "", newError("invalid port in HTTP host: ", host)
+		}
+		name, port = h, p
+	}
+	if net.ParseIP(name) != nil {
+		return host, nil
+	}
+	normalized, err := normalizeDomain(name)
+	if err != nil {
+		return "", newError("invalid HTTP host: ", host).Base(err)
+	}
+	if len(port) > 0 {
+		return net.JoinHostPort(normalized, port), nil
+	}
+	return normalized, nil
+}
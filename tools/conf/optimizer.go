@@ -0,0 +1,223 @@
+package conf
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strings"
+
+	"v2ray.com/core/app/dns"
+	"v2ray.com/core/app/router"
+)
+
+// isSiblingCIDR returns true if a and b are the two halves of the same CIDR.
+func isSiblingCIDR(a, b *router.CIDR) bool {
+	if cidrIPLen(a) != cidrIPLen(b) || a.Prefix != b.Prefix || a.Prefix == 0 {
+		return false
+	}
+	if bytes.Equal(a.Ip, b.Ip) {
+		return false
+	}
+	pa := normalizeCIDR(&router.CIDR{Ip: a.Ip, Prefix: a.Prefix - 1})
+	pb := normalizeCIDR(&router.CIDR{Ip: b.Ip, Prefix: b.Prefix - 1})
+	return bytes.Equal(pa.Ip, pb.Ip)
+}
+
+// mergeCIDRs returns the smallest list of CIDRs that covers exactly the same addresses as cidrs.
+func mergeCIDRs(cidrs []*router.CIDR) []*router.CIDR {
+	sorted := make([]*router.CIDR, 0, len(cidrs))
+	for _, c := range cidrs {
+		sorted = append(sorted, normalizeCIDR(c))
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if len(a.Ip) != len(b.Ip) {
+			return len(a.Ip) < len(b.Ip)
+		}
+		if r := bytes.Compare(a.Ip, b.Ip); r != 0 {
+			return r < 0
+		}
+		return a.Prefix < b.Prefix
+	})
+
+	merged := make([]*router.CIDR, 0, len(sorted))
+	for _, c := range sorted {
+		if n := len(merged); n > 0 && cidrContains(merged[n-1], c) {
+			continue
+		}
+		merged = append(merged, c)
+		for n := len(merged); n >= 2 && isSiblingCIDR(merged[n-2], merged[n-1]); n = len(merged) {
+			parent := normalizeCIDR(&router.CIDR{Ip: merged[n-2].Ip, Prefix: merged[n-2].Prefix - 1})
+			merged = append(merged[:n-2], parent)
+		}
+	}
+	return merged
+}
+
+// optimizeGeoIPList merges the CIDRs of each GeoIP entry.
+func optimizeGeoIPList(geoipList []*router.GeoIP) []*router.GeoIP {
+	for i, geoip := range geoipList {
+		cidrs := mergeCIDRs(geoip.Cidr)
+		if len(cidrs) == len(geoip.Cidr) {
+			continue
+		}
+		// GeoIP matchers are shared by country code, so a modified list must not keep it.
+		geoipList[i] = &router.GeoIP{
+			Cidr: cidrs,
+		}
+	}
+	return geoipList
+}
+
+func domainKey(d *router.Domain) string {
+	return d.Type.String() + ":" + d.Value
+}
+
+// optimizeDomains removes duplicated domains, and domains that are fully covered by another domain in the list.
+// Regular expressions are only deduplicated, as their coverage can't be decided.
+func optimizeDomains(domains []*router.Domain) []*router.Domain {
+	seen := make(map[string]bool, len(domains))
+	subdomains := make(map[string]bool)
+	var keywords []string
+	unique := make([]*router.Domain, 0, len(domains))
+	for _, d := range domains {
+		key := domainKey(d)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, d)
+		switch d.Type {
+		case router.Domain_Domain:
+			subdomains[d.Value] = true
+		case router.Domain_Plain:
+			keywords = append(keywords, d.Value)
+		}
+	}
+
+	isCovered := func(d *router.Domain) bool {
+		if d.Type == router.Domain_Regex {
+			return false
+		}
+		for _, keyword := range keywords {
+			if (d.Type != router.Domain_Plain || d.Value != keyword) && strings.Contains(d.Value, keyword) {
+				return true
+			}
+		}
+		if d.Type == router.Domain_Plain {
+			return false
+		}
+		if d.Type == router.Domain_Full && subdomains[d.Value] {
+			return true
+		}
+		for value := d.Value; ; {
+			idx := strings.IndexByte(value, '.')
+			if idx < 0 {
+				return false
+			}
+			value = value[idx+1:]
+			if subdomains[value] {
+				return true
+			}
+		}
+	}
+
+	result := make([]*router.Domain, 0, len(unique))
+	for _, d := range unique {
+		if !isCovered(d) {
+			result = append(result, d)
+		}
+	}
+	return result
+}
+
+func countCIDRs(rule *router.RoutingRule) int {
+	n := 0
+	for _, geoip := range rule.Geoip {
+		n += len(geoip.Cidr)
+	}
+	for _, geoip := range rule.SourceGeoip {
+		n += len(geoip.Cidr)
+	}
+	return n
+}
+
+// optimizeRouterConfig removes redundant domains and CIDRs from all routing rules, without changing the matching results.
+func optimizeRouterConfig(config *router.Config) {
+	domainsBefore, domainsAfter := 0, 0
+	cidrsBefore, cidrsAfter := 0, 0
+	for _, rule := range config.Rule {
+		domainsBefore += len(rule.Domain)
+		cidrsBefore += countCIDRs(rule)
+		if len(rule.Domain) > 0 {
+			rule.Domain = optimizeDomains(rule.Domain)
+		}
+		rule.Geoip = optimizeGeoIPList(rule.Geoip)
+		rule.SourceGeoip = optimizeGeoIPList(rule.SourceGeoip)
+		domainsAfter += len(rule.Domain)
+		cidrsAfter += countCIDRs(rule)
+	}
+	if domainsBefore != domainsAfter || cidrsBefore != cidrsAfter {
+		newError("routing rules optimized: domains ", domainsBefore, " -> ", domainsAfter, ", CIDRs ", cidrsBefore, " -> ", cidrsAfter).AtInfo().WriteToLog()
+	}
+}
+
+func hostMappingKey(mapping *dns.Config_HostMapping) string {
+	var b strings.Builder
+	b.WriteString(mapping.Type.String())
+	b.WriteString(":")
+	b.WriteString(mapping.Domain)
+	b.WriteString(">")
+	b.WriteString(mapping.ProxiedDomain)
+	for _, ip := range mapping.Ip {
+		b.WriteString(",")
+		b.WriteString(net.IP(ip).String())
+	}
+	return b.String()
+}
+
+// optimizeDnsConfig removes redundant priority domains and expected IPs from name servers, and duplicated static hosts.
+// Static hosts that are covered by others are kept, as they may map to different addresses.
+func optimizeDnsConfig(config *dns.Config) {
+	domainsBefore, domainsAfter := 0, 0
+	for _, ns := range config.NameServer {
+		ns.Geoip = optimizeGeoIPList(ns.Geoip)
+		domains := make([]*router.Domain, 0, len(ns.PrioritizedDomain))
+		for _, pd := range ns.PrioritizedDomain {
+			domains = append(domains, &router.Domain{
+				Type:  toRouterDomainType(pd.Type),
+				Value: pd.Domain,
+			})
+		}
+		domains = optimizeDomains(domains)
+		domainsBefore += len(ns.PrioritizedDomain)
+		domainsAfter += len(domains)
+		if len(domains) == len(ns.PrioritizedDomain) {
+			continue
+		}
+		ns.PrioritizedDomain = make([]*dns.NameServer_PriorityDomain, 0, len(domains))
+		for _, d := range domains {
+			ns.PrioritizedDomain = append(ns.PrioritizedDomain, &dns.NameServer_PriorityDomain{
+				Type:   toDomainMatchingType(d.Type),
+				Domain: d.Value,
+			})
+		}
+	}
+
+	hostsBefore := len(config.StaticHosts)
+	seen := make(map[string]bool, len(config.StaticHosts))
+	hosts := make([]*dns.Config_HostMapping, 0, len(config.StaticHosts))
+	for _, mapping := range config.StaticHosts {
+		key := hostMappingKey(mapping)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		hosts = append(hosts, mapping)
+	}
+	config.StaticHosts = hosts
+
+	if domainsBefore != domainsAfter || hostsBefore != len(hosts) {
+		newError("DNS config optimized: domains ", domainsBefore, " -> ", domainsAfter, ", hosts ", hostsBefore, " -> ", len(hosts)).AtInfo().WriteToLog()
+	}
+}
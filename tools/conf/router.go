@@ -1,7 +1,11 @@
 package conf
 
 import (
+	"bytes"
 	"encoding/json"
+	"regexp"
+	"regexp/syntax"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -10,6 +14,7 @@ import (
 	"v2ray.com/ext/sysio"
 
 	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/idna"
 )
 
 type RouterRulesConfig struct {
@@ -17,9 +22,47 @@ type RouterRulesConfig struct {
 	DomainStrategy string            `json:"domainStrategy"`
 }
 
+// BalancingStrategyConfig is the strategy of a balancer. The router only picks outbounds at random.
+type BalancingStrategyConfig struct {
+	Type string `json:"type"`
+}
+
 type BalancingRule struct {
-	Tag       string     `json:"tag"`
-	Selectors StringList `json:"selector"`
+	Tag         string                   `json:"tag"`
+	Selectors   StringList               `json:"selector"`
+	Strategy    *BalancingStrategyConfig `json:"strategy"`
+	HealthCheck *json.RawMessage         `json:"healthCheck"`
+}
+
+// SelectOutbounds returns the outbound tags that are matched by the selectors of this balancer.
+func (r *BalancingRule) SelectOutbounds(tags []string) []string {
+	var selected []string
+	for _, tag := range tags {
+		for _, selector := range r.Selectors {
+			if strings.HasPrefix(tag, selector) {
+				selected = append(selected, tag)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// ValidateSelectors returns an error if any of the selectors matches none of the outbound tags.
+func (r *BalancingRule) ValidateSelectors(tags []string) error {
+	for _, selector := range r.Selectors {
+		found := false
+		for _, tag := range tags {
+			if strings.HasPrefix(tag, selector) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return newError("selector ", selector, " of balancer ", r.Tag, " matches no outbound")
+		}
+	}
+	return nil
 }
 
 func (r *BalancingRule) Build() (*router.BalancingRule, error) {
@@ -29,6 +72,12 @@ func (r *BalancingRule) Build() (*router.BalancingRule, error) {
 	if len(r.Selectors) == 0 {
 		return nil, newError("empty selector list")
 	}
+	if r.Strategy != nil && len(r.Strategy.Type) > 0 && strings.ToLower(r.Strategy.Type) != "random" {
+		return nil, newError("unsupported balancer strategy: ", r.Strategy.Type)
+	}
+	if r.HealthCheck != nil {
+		return nil, newError("unsupported balancer health check in balancer ", r.Tag)
+	}
 
 	return &router.BalancingRule{
 		Tag:              r.Tag,
@@ -63,37 +112,99 @@ func (c *RouterConfig) getDomainStrategy() router.Config_DomainStrategy {
 	}
 }
 
-func (c *RouterConfig) Build() (*router.Config, error) {
-	config := new(router.Config)
-	config.DomainStrategy = c.getDomainStrategy()
-
+func (c *RouterConfig) getRuleList() []json.RawMessage {
 	rawRuleList := c.RuleList
 	if c.Settings != nil {
 		rawRuleList = append(c.RuleList, c.Settings.RuleList...)
 	}
-	for _, rawRule := range rawRuleList {
-		rule, err := ParseRule(rawRule)
+	return rawRuleList
+}
+
+// build builds the router config. It also returns, for each routing rule, the index of the JSON rule it comes from.
+func (c *RouterConfig) build() (*router.Config, []int, error) {
+	config := new(router.Config)
+	config.DomainStrategy = c.getDomainStrategy()
+
+	type ruleEntry struct {
+		idx    int
+		header RouterRule
+		raw    json.RawMessage
+	}
+	var entries []*ruleEntry
+	names := make(map[string]int)
+	for idx, rawRule := range c.getRuleList() {
+		entry := &ruleEntry{idx: idx, raw: rawRule}
+		if err := json.Unmarshal(rawRule, &entry.header); err != nil {
+			return nil, nil, newError("invalid routing rule ", idx).Base(err)
+		}
+		if name := entry.header.Name; len(name) > 0 {
+			if prev, found := names[name]; found {
+				return nil, nil, newError("duplicated name ", name, " of routing rules ", prev, " and ", idx)
+			}
+			names[name] = idx
+		}
+		if entry.header.isEnabled() {
+			entries = append(entries, entry)
+		}
+	}
+	// Rules with smaller priority values are matched first. Rules of the same priority keep their order in JSON.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].header.Priority < entries[j].header.Priority
+	})
+
+	var origins []int
+	for _, entry := range entries {
+		idx := entry.idx
+		rules, err := ParseRules(entry.raw)
 		if err != nil {
-			return nil, err
+			return nil, nil, newError("failed to build routing rule ", entry.header.label(idx)).Base(err)
+		}
+		config.Rule = append(config.Rule, rules...)
+		for range rules {
+			origins = append(origins, idx)
 		}
-		config.Rule = append(config.Rule, rule)
 	}
 	for _, rawBalancer := range c.Balancers {
 		balancer, err := rawBalancer.Build()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		config.BalancingRule = append(config.BalancingRule, balancer)
 	}
-	return config, nil
+
+	optimizeRouterConfig(config)
+
+	return config, origins, nil
+}
+
+func (c *RouterConfig) Build() (*router.Config, error) {
+	config, _, err := c.build()
+	return config, err
 }
 
 type RouterRule struct {
 	Type        string `json:"type"`
 	OutboundTag string `json:"outboundTag"`
 	BalancerTag string `json:"balancerTag"`
+	Name        string `json:"name"`
+	Priority    int32  `json:"priority"`
+	Enabled     *bool  `json:"enabled"`
 }
 
+func (r *RouterRule) isEnabled() bool {
+	return r.Enabled == nil || *r.Enabled
+}
+
+// label returns a human readable identifier of the rule at index idx of the rule list.
+func (r *RouterRule) label(idx int) string {
+	if len(r.Name) > 0 {
+		return strconv.Itoa(idx) + " (" + r.Name + ")"
+	}
+	return strconv.Itoa(idx)
+}
+
+// ParseIP parses an IP address or a CIDR. IPv4-mapped IPv6 addresses are converted to IPv4.
+// It is an error if host bits are set beyond the prefix length.
 func ParseIP(s string) (*router.CIDR, error) {
 	var addr, mask string
 	i := strings.Index(s, "/")
@@ -104,42 +215,65 @@ func ParseIP(s string) (*router.CIDR, error) {
 		mask = s[i+1:]
 	}
 	ip := net.ParseAddress(addr)
+	var maxBits, offset uint32
 	switch ip.Family() {
 	case net.AddressFamilyIPv4:
-		bits := uint32(32)
-		if len(mask) > 0 {
-			bits64, err := strconv.ParseUint(mask, 10, 32)
-			if err != nil {
-				return nil, newError("invalid network mask for router: ", mask).Base(err)
-			}
-			bits = uint32(bits64)
-		}
-		if bits > 32 {
-			return nil, newError("invalid network mask for router: ", bits)
+		maxBits = 32
+		if strings.Contains(addr, ":") {
+			// IPv4-mapped IPv6 address, such as ::ffff:1.2.3.4
+			offset = 96
 		}
-		return &router.CIDR{
-			Ip:     []byte(ip.IP()),
-			Prefix: bits,
-		}, nil
 	case net.AddressFamilyIPv6:
-		bits := uint32(128)
-		if len(mask) > 0 {
-			bits64, err := strconv.ParseUint(mask, 10, 32)
-			if err != nil {
-				return nil, newError("invalid network mask for router: ", mask).Base(err)
-			}
-			bits = uint32(bits64)
-		}
-		if bits > 128 {
-			return nil, newError("invalid network mask for router: ", bits)
-		}
-		return &router.CIDR{
-			Ip:     []byte(ip.IP()),
-			Prefix: bits,
-		}, nil
+		maxBits = 128
 	default:
 		return nil, newError("unsupported address for router: ", s)
 	}
+
+	bits := maxBits
+	if len(mask) > 0 {
+		bits64, err := strconv.ParseUint(mask, 10, 32)
+		if err != nil {
+			return nil, newError("invalid network mask for router: ", mask).Base(err)
+		}
+		if bits64 < uint64(offset) || bits64 > uint64(maxBits+offset) {
+			return nil, newError("invalid network mask for router: ", bits64)
+		}
+		bits = uint32(bits64) - offset
+	}
+
+	cidr := &router.CIDR{
+		Ip:     []byte(ip.IP()),
+		Prefix: bits,
+	}
+	if network := normalizeCIDR(cidr); !bytes.Equal(network.Ip, cidr.Ip) {
+		return nil, newError("host bits are set beyond the network mask in ", s, ", the network address is ", net.IP(network.Ip).String(), "/", bits)
+	}
+	return cidr, nil
+}
+
+func parseIPRangeBounds(s string) (net.IP, net.IP, error) {
+	pair := strings.SplitN(s, "-", 2)
+	if len(pair) != 2 {
+		return nil, nil, newError("invalid IP range: ", s)
+	}
+	start := net.ParseAddress(strings.TrimSpace(pair[0]))
+	end := net.ParseAddress(strings.TrimSpace(pair[1]))
+	if !start.Family().IsIP() || start.Family() != end.Family() {
+		return nil, nil, newError("invalid IP range: ", s)
+	}
+	if bytes.Compare(start.IP(), end.IP()) > 0 {
+		return nil, nil, newError("start of IP range is after its end: ", s)
+	}
+	return start.IP(), end.IP(), nil
+}
+
+// ParseIPRange parses an IP range in the form of "start-end", into the smallest list of CIDRs that covers it.
+func ParseIPRange(s string) ([]*router.CIDR, error) {
+	start, end, err := parseIPRangeBounds(s)
+	if err != nil {
+		return nil, err
+	}
+	return rangeToCIDRs(start, end), nil
 }
 
 func loadGeoIP(country string) ([]*router.CIDR, error) {
@@ -199,6 +333,57 @@ func (m BooleanMatcher) Match(domain *router.Domain) bool {
 	return false
 }
 
+// NotMatcher matches domains that are not matched by the underlying matcher.
+type NotMatcher struct {
+	Matcher AttributeMatcher
+}
+
+func (m NotMatcher) Match(domain *router.Domain) bool {
+	return !m.Matcher.Match(domain)
+}
+
+// AnyMatcher matches domains that are matched by at least one of the underlying matchers.
+type AnyMatcher []AttributeMatcher
+
+func (m AnyMatcher) Match(domain *router.Domain) bool {
+	for _, matcher := range m {
+		if matcher.Match(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// IntValueMatcher matches domains with an integer attribute of the given value.
+type IntValueMatcher struct {
+	Key   string
+	Value int64
+}
+
+func (m IntValueMatcher) Match(domain *router.Domain) bool {
+	for _, attr := range domain.Attribute {
+		if v, ok := attr.TypedValue.(*router.Domain_Attribute_IntValue); ok && attr.Key == m.Key && v.IntValue == m.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// BoolValueMatcher matches domains with a boolean attribute of the given value.
+type BoolValueMatcher struct {
+	Key   string
+	Value bool
+}
+
+func (m BoolValueMatcher) Match(domain *router.Domain) bool {
+	for _, attr := range domain.Attribute {
+		if v, ok := attr.TypedValue.(*router.Domain_Attribute_BoolValue); ok && attr.Key == m.Key && v.BoolValue == m.Value {
+			return true
+		}
+	}
+	return false
+}
+
 type AttributeList struct {
 	matcher []AttributeMatcher
 }
@@ -216,13 +401,60 @@ func (al *AttributeList) IsEmpty() bool {
 	return len(al.matcher) == 0
 }
 
-func parseAttrs(attrs []string) *AttributeList {
+// parseAttr parses a single attribute term, in the form of "key", "!key" or "key=value".
+func parseAttr(attr string) (AttributeMatcher, error) {
+	if strings.HasPrefix(attr, "!") {
+		matcher, err := parseAttr(attr[1:])
+		if err != nil {
+			return nil, err
+		}
+		return NotMatcher{Matcher: matcher}, nil
+	}
+
+	kv := strings.SplitN(attr, "=", 2)
+	key := kv[0]
+	if len(key) == 0 {
+		return nil, newError("empty attribute in: ", attr)
+	}
+	if len(kv) == 1 {
+		return BooleanMatcher(key), nil
+	}
+
+	value := kv[1]
+	switch value {
+	case "true":
+		return BoolValueMatcher{Key: key, Value: true}, nil
+	case "false":
+		return BoolValueMatcher{Key: key, Value: false}, nil
+	}
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return IntValueMatcher{Key: key, Value: i}, nil
+	}
+	return nil, newError("invalid value of attribute ", key, ": ", value)
+}
+
+// parseAttrs parses the attribute expressions of a geosite reference. All expressions must match,
+// while alternatives separated by "|" in an expression only need one of them to match.
+func parseAttrs(attrs []string) (*AttributeList, error) {
 	al := new(AttributeList)
 	for _, attr := range attrs {
 		lc := strings.ToLower(attr)
-		al.matcher = append(al.matcher, BooleanMatcher(lc))
+		alternatives := strings.Split(lc, "|")
+		group := make(AnyMatcher, 0, len(alternatives))
+		for _, alt := range alternatives {
+			matcher, err := parseAttr(strings.TrimSpace(alt))
+			if err != nil {
+				return nil, newError("invalid attribute expression: ", attr).Base(err)
+			}
+			group = append(group, matcher)
+		}
+		if len(group) == 1 {
+			al.matcher = append(al.matcher, group[0])
+		} else {
+			al.matcher = append(al.matcher, group)
+		}
 	}
-	return al
+	return al, nil
 }
 
 func loadGeositeWithAttr(file string, siteWithAttr string) ([]*router.Domain, error) {
@@ -231,7 +463,10 @@ func loadGeositeWithAttr(file string, siteWithAttr string) ([]*router.Domain, er
 		return nil, newError("empty site")
 	}
 	country := strings.ToUpper(parts[0])
-	attrs := parseAttrs(parts[1:])
+	attrs, err := parseAttrs(parts[1:])
+	if err != nil {
+		return nil, err
+	}
 	domains, err := loadSite(file, country)
 	if err != nil {
 		return nil, err
@@ -261,6 +496,17 @@ func parseDomainRule(domain string) ([]*router.Domain, error) {
 		return domains, nil
 	}
 
+	if strings.HasPrefix(domain, "ruleset:") {
+		ruleset, err := DefaultRulesetLoader.Load(domain[8:])
+		if err != nil {
+			return nil, newError("failed to load rule set: ", domain[8:]).Base(err)
+		}
+		if len(ruleset.Domain) == 0 {
+			return nil, newError("rule set contains no domain: ", domain[8:])
+		}
+		return ruleset.Domain, nil
+	}
+
 	if strings.HasPrefix(domain, "ext:") {
 		kv := strings.Split(domain[4:], ":")
 		if len(kv) != 2 {
@@ -278,66 +524,307 @@ func parseDomainRule(domain string) ([]*router.Domain, error) {
 	domainRule := new(router.Domain)
 	switch {
 	case strings.HasPrefix(domain, "regexp:"):
+		if err := validateRegexp(domain[7:]); err != nil {
+			return nil, err
+		}
 		domainRule.Type = router.Domain_Regex
 		domainRule.Value = domain[7:]
 	case strings.HasPrefix(domain, "domain:"):
+		value, err := normalizeDomain(domain[7:])
+		if err != nil {
+			return nil, err
+		}
 		domainRule.Type = router.Domain_Domain
-		domainRule.Value = domain[7:]
+		domainRule.Value = value
 	case strings.HasPrefix(domain, "full:"):
+		value, err := normalizeDomain(domain[5:])
+		if err != nil {
+			return nil, err
+		}
 		domainRule.Type = router.Domain_Full
-		domainRule.Value = domain[5:]
+		domainRule.Value = value
+	case strings.HasPrefix(domain, "keyword:"):
+		domainRule.Type = router.Domain_Plain
+		domainRule.Value = strings.ToLower(domain[8:])
 	default:
 		domainRule.Type = router.Domain_Plain
-		domainRule.Value = domain
+		domainRule.Value = strings.ToLower(domain)
 	}
 	return []*router.Domain{domainRule}, nil
 }
 
-func toCidrList(ips StringList) ([]*router.GeoIP, error) {
-	var geoipList []*router.GeoIP
-	var customCidrs []*router.CIDR
+var idnaProfile = idna.New(idna.MapForLookup(), idna.StrictDomainName(false), idna.BidiRule())
 
-	for _, ip := range ips {
-		if strings.HasPrefix(ip, "geoip:") {
-			country := ip[6:]
-			geoip, err := loadGeoIP(strings.ToUpper(country))
-			if err != nil {
-				return nil, newError("failed to load GeoIP: ", country).Base(err)
+// normalizeDomain converts an internationalized domain name to lower case punycode, as it appears on the wire.
+// It is an error if the result is not a valid hostname. Underscores are allowed, as they are common in practice.
+func normalizeDomain(domain string) (string, error) {
+	value, err := idnaProfile.ToASCII(strings.TrimSuffix(domain, "."))
+	if err != nil {
+		return "", newError("invalid domain name: ", domain).Base(err)
+	}
+	if len(value) == 0 || len(value) > 253 {
+		return "", newError("invalid length of domain name: ", domain)
+	}
+	for _, label := range strings.Split(value, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return "", newError("invalid label length in domain name: ", domain)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return "", newError("label starts or ends with hyphen in domain name: ", domain)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return "", newError("invalid character ", strconv.QuoteRune(c), " in domain name: ", domain)
 			}
+		}
+	}
+	return value, nil
+}
 
-			geoipList = append(geoipList, &router.GeoIP{
-				CountryCode: strings.ToUpper(country),
-				Cidr:        geoip,
-			})
-			continue
+// validateRegexp compiles pattern, and reports the offending sub-expression if any.
+func validateRegexp(pattern string) error {
+	_, err := regexp.Compile(pattern)
+	if err == nil {
+		return nil
+	}
+	if rErr, ok := err.(*syntax.Error); ok {
+		// The parser doesn't report positions, so the offending expression is located in the pattern.
+		if offset := strings.Index(pattern, rErr.Expr); offset >= 0 {
+			return newError("invalid regular expression ", pattern, ": ", rErr.Code.String(), " in `", rErr.Expr, "` at offset ", offset)
 		}
+		return newError("invalid regular expression ", pattern, ": ", rErr.Code.String(), " in `", rErr.Expr, "`")
+	}
+	return newError("invalid regular expression ", pattern).Base(err)
+}
 
-		if strings.HasPrefix(ip, "ext:") {
-			kv := strings.Split(ip[4:], ":")
-			if len(kv) != 2 {
-				return nil, newError("invalid external resource: ", ip)
+// domainRuleString returns the domain rule in the form it is written in config.
+func domainRuleString(d *router.Domain) string {
+	switch d.Type {
+	case router.Domain_Domain:
+		return "domain:" + d.Value
+	case router.Domain_Full:
+		return "full:" + d.Value
+	case router.Domain_Regex:
+		return "regexp:" + d.Value
+	default:
+		return "keyword:" + d.Value
+	}
+}
+
+// domainCovers returns true if every domain matched by b is also matched by a.
+func domainCovers(a, b *router.Domain) bool {
+	switch a.Type {
+	case router.Domain_Plain:
+		return b.Type != router.Domain_Regex && strings.Contains(b.Value, a.Value)
+	case router.Domain_Domain:
+		if b.Type != router.Domain_Domain && b.Type != router.Domain_Full {
+			return false
+		}
+		return b.Value == a.Value || strings.HasSuffix(b.Value, "."+a.Value)
+	default:
+		return a.Type == b.Type && a.Value == b.Value
+	}
+}
+
+// domainIndex looks up the rules in a list that cover a given rule, without comparing it to every rule in the list.
+type domainIndex struct {
+	exact    map[router.Domain_Type]map[string][]*router.Domain
+	domains  map[string][]*router.Domain
+	keywords []*router.Domain
+}
+
+func newDomainIndex(rules []*router.Domain) *domainIndex {
+	index := &domainIndex{
+		exact:   make(map[router.Domain_Type]map[string][]*router.Domain),
+		domains: make(map[string][]*router.Domain),
+	}
+	for _, r := range rules {
+		switch r.Type {
+		case router.Domain_Plain:
+			index.keywords = append(index.keywords, r)
+		case router.Domain_Domain:
+			index.domains[r.Value] = append(index.domains[r.Value], r)
+		default:
+			if index.exact[r.Type] == nil {
+				index.exact[r.Type] = make(map[string][]*router.Domain)
 			}
+			index.exact[r.Type][r.Value] = append(index.exact[r.Type][r.Value], r)
+		}
+	}
+	return index
+}
 
-			filename := kv[0]
-			country := kv[1]
-			geoip, err := loadGeoIP(strings.ToUpper(country))
-			if err != nil {
-				return nil, newError("failed to load IPs: ", country, " from ", filename).Base(err)
+// covering returns all rules in the index that cover d, as defined by domainCovers.
+func (index *domainIndex) covering(d *router.Domain) []*router.Domain {
+	var result []*router.Domain
+	result = append(result, index.exact[d.Type][d.Value]...)
+	if d.Type == router.Domain_Domain || d.Type == router.Domain_Full {
+		value := d.Value
+		for {
+			result = append(result, index.domains[value]...)
+			dot := strings.IndexByte(value, '.')
+			if dot < 0 {
+				break
 			}
+			value = value[dot+1:]
+		}
+	}
+	if d.Type != router.Domain_Regex {
+		for _, k := range index.keywords {
+			if strings.Contains(d.Value, k.Value) {
+				result = append(result, k)
+			}
+		}
+	}
+	return result
+}
 
-			geoipList = append(geoipList, &router.GeoIP{
-				CountryCode: strings.ToUpper(filename + "_" + country),
-				Cidr:        geoip,
-			})
+// parseDomainRules parses a list of domain rules. Rules prefixed with "!" are excluded from the result.
+// As the router has no notion of negation, an exclusion removes every included domain it fully covers.
+// An included domain that is only partly covered by an exclusion is kept, with a warning.
+func parseDomainRules(domains []string) ([]*router.Domain, error) {
+	var included, excluded []*router.Domain
+	for _, domain := range domains {
+		exclude := strings.HasPrefix(domain, "!")
+		if exclude {
+			domain = domain[1:]
+		}
+		rules, err := parseDomainRule(domain)
+		if err != nil {
+			return nil, newError("failed to parse domain rule: ", domain).Base(err)
+		}
+		if exclude {
+			excluded = append(excluded, rules...)
+		} else {
+			included = append(included, rules...)
+		}
+	}
 
-			continue
+	if len(excluded) == 0 {
+		return included, nil
+	}
+	if len(included) == 0 {
+		return nil, newError("domain exclusions must be used along with at least one included domain")
+	}
+
+	excludedIndex := newDomainIndex(excluded)
+	applied := make(map[*router.Domain]bool, len(excluded))
+	result := make([]*router.Domain, 0, len(included))
+	for _, d := range included {
+		covering := excludedIndex.covering(d)
+		for _, e := range covering {
+			applied[e] = true
+		}
+		if len(covering) == 0 {
+			result = append(result, d)
+		}
+	}
+
+	resultIndex := newDomainIndex(result)
+	for _, e := range excluded {
+		for _, d := range resultIndex.covering(e) {
+			newError("exclusion ", domainRuleString(e), " covers only a part of ", domainRuleString(d), ", which can't be excluded by the router and stays included").AtWarning().WriteToLog()
 		}
+		if !applied[e] {
+			newError("exclusion ", domainRuleString(e), " doesn't fully cover any included domain, and is ignored").AtWarning().WriteToLog()
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, newError("no domain left after applying exclusions")
+	}
+	return result, nil
+}
 
-		ipRule, err := ParseIP(ip)
+func parseIPRule(ip string) (*router.GeoIP, error) {
+	if strings.HasPrefix(ip, "geoip:") {
+		country := ip[6:]
+		geoip, err := loadGeoIP(strings.ToUpper(country))
 		if err != nil {
-			return nil, newError("invalid IP: ", ip).Base(err)
+			return nil, newError("failed to load GeoIP: ", country).Base(err)
+		}
+
+		return &router.GeoIP{
+			CountryCode: strings.ToUpper(country),
+			Cidr:        geoip,
+		}, nil
+	}
+
+	if strings.HasPrefix(ip, "ext:") {
+		kv := strings.Split(ip[4:], ":")
+		if len(kv) != 2 {
+			return nil, newError("invalid external resource: ", ip)
+		}
+
+		filename := kv[0]
+		country := kv[1]
+		geoip, err := loadGeoIP(strings.ToUpper(country))
+		if err != nil {
+			return nil, newError("failed to load IPs: ", country, " from ", filename).Base(err)
+		}
+
+		return &router.GeoIP{
+			CountryCode: strings.ToUpper(filename + "_" + country),
+			Cidr:        geoip,
+		}, nil
+	}
+
+	if strings.HasPrefix(ip, "ruleset:") {
+		ruleset, err := DefaultRulesetLoader.Load(ip[8:])
+		if err != nil {
+			return nil, newError("failed to load rule set: ", ip[8:]).Base(err)
+		}
+		if len(ruleset.Cidr) == 0 {
+			return nil, newError("rule set contains no IP: ", ip[8:])
+		}
+		return &router.GeoIP{
+			Cidr: ruleset.Cidr,
+		}, nil
+	}
+
+	if strings.Contains(ip, "-") {
+		cidrs, err := ParseIPRange(ip)
+		if err != nil {
+			return nil, newError("invalid IP range: ", ip).Base(err)
+		}
+		return &router.GeoIP{
+			Cidr: cidrs,
+		}, nil
+	}
+
+	ipRule, err := ParseIP(ip)
+	if err != nil {
+		return nil, newError("invalid IP: ", ip).Base(err)
+	}
+	return &router.GeoIP{
+		Cidr: []*router.CIDR{ipRule},
+	}, nil
+}
+
+// toCidrList parses a list of IP rules. Rules prefixed with "!" are excluded from the result.
+// If there are only exclusions, they are excluded from the whole address space.
+func toCidrList(ips StringList) ([]*router.GeoIP, error) {
+	var geoipList []*router.GeoIP
+	var customCidrs []*router.CIDR
+	var excludedCidrs []*router.CIDR
+
+	for _, ip := range ips {
+		exclude := strings.HasPrefix(ip, "!")
+		if exclude {
+			ip = ip[1:]
+		}
+		geoip, err := parseIPRule(ip)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case exclude:
+			excludedCidrs = append(excludedCidrs, geoip.Cidr...)
+		case len(geoip.CountryCode) == 0:
+			customCidrs = append(customCidrs, geoip.Cidr...)
+		default:
+			geoipList = append(geoipList, geoip)
 		}
-		customCidrs = append(customCidrs, ipRule)
 	}
 
 	if len(customCidrs) > 0 {
@@ -346,15 +833,47 @@ func toCidrList(ips StringList) ([]*router.GeoIP, error) {
 		})
 	}
 
+	if len(excludedCidrs) > 0 {
+		if len(geoipList) == 0 {
+			geoipList = append(geoipList, &router.GeoIP{
+				Cidr: allCIDRs(),
+			})
+		}
+		geoipList = excludeCidrs(geoipList, excludedCidrs)
+		if len(geoipList) == 0 {
+			return nil, newError("no IP left after applying exclusions")
+		}
+	}
+
 	return geoipList, nil
 }
 
-func parseFieldRule(msg json.RawMessage) (*router.RoutingRule, error) {
+func excludeCidrs(geoipList []*router.GeoIP, excluded []*router.CIDR) []*router.GeoIP {
+	result := make([]*router.GeoIP, 0, len(geoipList))
+	for _, geoip := range geoipList {
+		cidrs, changed := subtractCIDRs(geoip.Cidr, excluded)
+		if len(cidrs) == 0 {
+			continue
+		}
+		countryCode := geoip.CountryCode
+		if changed {
+			// GeoIP matchers are shared by country code, so a modified list must not keep it.
+			countryCode = ""
+		}
+		result = append(result, &router.GeoIP{
+			CountryCode: countryCode,
+			Cidr:        cidrs,
+		})
+	}
+	return result
+}
+
+func parseFieldRule(msg json.RawMessage) ([]*router.RoutingRule, error) {
 	type RawFieldRule struct {
 		RouterRule
 		Domain     *StringList  `json:"domain"`
 		IP         *StringList  `json:"ip"`
-		Port       *PortRange   `json:"port"`
+		Port       *PortList    `json:"port"`
 		Network    *NetworkList `json:"network"`
 		SourceIP   *StringList  `json:"source"`
 		User       *StringList  `json:"user"`
@@ -381,13 +900,11 @@ func parseFieldRule(msg json.RawMessage) (*router.RoutingRule, error) {
 	}
 
 	if rawFieldRule.Domain != nil {
-		for _, domain := range *rawFieldRule.Domain {
-			rules, err := parseDomainRule(domain)
-			if err != nil {
-				return nil, newError("failed to parse domain rule: ", domain).Base(err)
-			}
-			rule.Domain = append(rule.Domain, rules...)
+		domains, err := parseDomainRules(*rawFieldRule.Domain)
+		if err != nil {
+			return nil, err
 		}
+		rule.Domain = domains
 	}
 
 	if rawFieldRule.IP != nil {
@@ -398,10 +915,6 @@ func parseFieldRule(msg json.RawMessage) (*router.RoutingRule, error) {
 		rule.Geoip = geoipList
 	}
 
-	if rawFieldRule.Port != nil {
-		rule.PortRange = rawFieldRule.Port.Build()
-	}
-
 	if rawFieldRule.Network != nil {
 		rule.Networks = rawFieldRule.Network.Build()
 	}
@@ -432,35 +945,61 @@ func parseFieldRule(msg json.RawMessage) (*router.RoutingRule, error) {
 		}
 	}
 
-	return rule, nil
+	if rawFieldRule.Port == nil {
+		return []*router.RoutingRule{rule}, nil
+	}
+
+	// A routing rule holds only one port range, so the rule is duplicated for each range in the list.
+	portRanges := rawFieldRule.Port.Build()
+	rules := make([]*router.RoutingRule, 0, len(portRanges))
+	for _, portRange := range portRanges {
+		r := proto.Clone(rule).(*router.RoutingRule)
+		r.PortRange = portRange
+		rules = append(rules, r)
+	}
+	return rules, nil
 }
 
+// ParseRule parses a routing rule from JSON. It fails if the rule has to be split into multiple routing rules,
+// which must be parsed by ParseRules.
 func ParseRule(msg json.RawMessage) (*router.RoutingRule, error) {
+	rules, err := ParseRules(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) != 1 {
+		return nil, newError("routing rule matches multiple port ranges, and can't be built into a single rule")
+	}
+	return rules[0], nil
+}
+
+// ParseRules parses a routing rule from JSON. A rule with multiple port ranges results in one routing rule for each range.
+func ParseRules(msg json.RawMessage) ([]*router.RoutingRule, error) {
 	rawRule := new(RouterRule)
 	err := json.Unmarshal(msg, rawRule)
 	if err != nil {
 		return nil, newError("invalid router rule").Base(err)
 	}
 	if rawRule.Type == "field" {
-		fieldrule, err := parseFieldRule(msg)
+		fieldrules, err := parseFieldRule(msg)
 		if err != nil {
 			return nil, newError("invalid field rule").Base(err)
 		}
-		return fieldrule, nil
+		return fieldrules, nil
 	}
 	if rawRule.Type == "chinaip" {
 		chinaiprule, err := parseChinaIPRule(msg)
 		if err != nil {
 			return nil, newError("invalid chinaip rule").Base(err)
 		}
-		return chinaiprule, nil
+		return []*router.RoutingRule{chinaiprule}, nil
 	}
 	if rawRule.Type == "chinasites" {
 		chinasitesrule, err := parseChinaSitesRule(msg)
 		if err != nil {
 			return nil, newError("invalid chinasites rule").Base(err)
 		}
-		return chinasitesrule, nil
+		return []*router.RoutingRule{chinasitesrule}, nil
 	}
 	return nil, newError("unknown router rule type: ", rawRule.Type)
 }
@@ -0,0 +1,201 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"v2ray.com/core/app/router"
+	"v2ray.com/core/common/net"
+)
+
+// RouterIssue is a potential problem found in routing rules.
+type RouterIssue struct {
+	// Rule is the index of the JSON rule in the rule list, or -1 if the issue is not about a rule.
+	Rule int
+	// Name is the name of the rule, if any.
+	Name    string
+	Message string
+}
+
+func (i *RouterIssue) String() string {
+	if i.Rule < 0 {
+		return i.Message
+	}
+	if len(i.Name) > 0 {
+		return fmt.Sprintf("rule %d (%s): %s", i.Rule, i.Name, i.Message)
+	}
+	return fmt.Sprintf("rule %d: %s", i.Rule, i.Message)
+}
+
+func domainsCovered(a, b []*router.Domain) bool {
+	index := newDomainIndex(a)
+	for _, d := range b {
+		if len(index.covering(d)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func geoipCIDRs(geoipList []*router.GeoIP) []*router.CIDR {
+	var cidrs []*router.CIDR
+	for _, geoip := range geoipList {
+		cidrs = append(cidrs, geoip.Cidr...)
+	}
+	return cidrs
+}
+
+func cidrsCovered(a, b []*router.CIDR) bool {
+	remaining, _ := subtractCIDRs(b, a)
+	return len(remaining) == 0
+}
+
+func stringsCovered(a, b []string) bool {
+	set := make(map[string]bool, len(a))
+	for _, s := range a {
+		set[s] = true
+	}
+	for _, s := range b {
+		if !set[s] {
+			return false
+		}
+	}
+	return true
+}
+
+func networksCovered(a, b []net.Network) bool {
+	for _, n := range b {
+		if !net.HasNetwork(a, n) {
+			return false
+		}
+	}
+	return true
+}
+
+// ruleCovers returns true if every connection matched by rule b is also matched by rule a.
+func ruleCovers(a, b *router.RoutingRule) bool {
+	if len(a.Domain) > 0 && (len(b.Domain) == 0 || !domainsCovered(a.Domain, b.Domain)) {
+		return false
+	}
+	aIPs := append(geoipCIDRs(a.Geoip), a.Cidr...)
+	bIPs := append(geoipCIDRs(b.Geoip), b.Cidr...)
+	if len(aIPs) > 0 && (len(bIPs) == 0 || !cidrsCovered(aIPs, bIPs)) {
+		return false
+	}
+	aSourceIPs := append(geoipCIDRs(a.SourceGeoip), a.SourceCidr...)
+	bSourceIPs := append(geoipCIDRs(b.SourceGeoip), b.SourceCidr...)
+	if len(aSourceIPs) > 0 && (len(bSourceIPs) == 0 || !cidrsCovered(aSourceIPs, bSourceIPs)) {
+		return false
+	}
+	if a.PortRange != nil && (b.PortRange == nil || b.PortRange.From < a.PortRange.From || b.PortRange.To > a.PortRange.To) {
+		return false
+	}
+	if len(a.Networks) > 0 && (len(b.Networks) == 0 || !networksCovered(a.Networks, b.Networks)) {
+		return false
+	}
+	if len(a.UserEmail) > 0 && (len(b.UserEmail) == 0 || !stringsCovered(a.UserEmail, b.UserEmail)) {
+		return false
+	}
+	if len(a.InboundTag) > 0 && (len(b.InboundTag) == 0 || !stringsCovered(a.InboundTag, b.InboundTag)) {
+		return false
+	}
+	if len(a.Protocol) > 0 && (len(b.Protocol) == 0 || !stringsCovered(a.Protocol, b.Protocol)) {
+		return false
+	}
+	return true
+}
+
+func hasMatcher(rule *router.RoutingRule) bool {
+	return len(rule.Domain) > 0 || len(rule.Geoip) > 0 || len(rule.Cidr) > 0 ||
+		len(rule.SourceGeoip) > 0 || len(rule.SourceCidr) > 0 || rule.PortRange != nil ||
+		len(rule.Networks) > 0 || len(rule.UserEmail) > 0 || len(rule.InboundTag) > 0 || len(rule.Protocol) > 0
+}
+
+// checkEmptyMatchers reports matchers that are specified in JSON, but resolve to nothing in the built rule.
+func checkEmptyMatchers(idx int, rawRule json.RawMessage, rule *router.RoutingRule) []*RouterIssue {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(rawRule, &fields); err != nil {
+		return nil
+	}
+
+	var issues []*RouterIssue
+	if _, found := fields["domain"]; found && len(rule.Domain) == 0 {
+		issues = append(issues, &RouterIssue{Rule: idx, Message: "domain matcher resolves to no domain"})
+	}
+	if _, found := fields["ip"]; found && len(rule.Geoip) == 0 {
+		issues = append(issues, &RouterIssue{Rule: idx, Message: "ip matcher resolves to no IP"})
+	}
+	if _, found := fields["source"]; found && len(rule.SourceGeoip) == 0 {
+		issues = append(issues, &RouterIssue{Rule: idx, Message: "source matcher resolves to no IP"})
+	}
+	return issues
+}
+
+// Check builds the router config, and reports rules that can never be hit because earlier rules cover them completely,
+// rules with matchers that resolve to nothing, and balancers that are not referenced by any rule.
+func (c *RouterConfig) Check() ([]*RouterIssue, error) {
+	config, origins, err := c.build()
+	if err != nil {
+		return nil, err
+	}
+	rawRuleList := c.getRuleList()
+	headers := make([]RouterRule, len(rawRuleList))
+	for idx, rawRule := range rawRuleList {
+		if err := json.Unmarshal(rawRule, &headers[idx]); err != nil {
+			return nil, err
+		}
+	}
+
+	var issues []*RouterIssue
+	shadowedBy := make([]int, len(config.Rule))
+	for i, rule := range config.Rule {
+		shadowedBy[i] = -1
+		for j := 0; j < i; j++ {
+			if origins[j] != origins[i] && ruleCovers(config.Rule[j], rule) {
+				shadowedBy[i] = origins[j]
+				break
+			}
+		}
+	}
+
+	// A JSON rule may be built into multiple routing rules. It is only reported as shadowed if all of them are.
+	for i, rule := range config.Rule {
+		idx := origins[i]
+		if i > 0 && origins[i-1] == idx {
+			continue
+		}
+		ruleIssues := checkEmptyMatchers(idx, rawRuleList[idx], rule)
+		if !hasMatcher(rule) {
+			ruleIssues = append(ruleIssues, &RouterIssue{Rule: idx, Message: "rule has no effective matcher"})
+		}
+		shadowed := true
+		for j := i; j < len(config.Rule) && origins[j] == idx; j++ {
+			if shadowedBy[j] < 0 {
+				shadowed = false
+				break
+			}
+		}
+		if shadowed {
+			by := shadowedBy[i]
+			ruleIssues = append(ruleIssues, &RouterIssue{Rule: idx, Message: "shadowed by rule " + headers[by].label(by)})
+		}
+		for _, issue := range ruleIssues {
+			issue.Name = headers[idx].Name
+		}
+		issues = append(issues, ruleIssues...)
+	}
+
+	referenced := make(map[string]bool)
+	for _, rule := range config.Rule {
+		if tag := rule.GetBalancingTag(); len(tag) > 0 {
+			referenced[tag] = true
+		}
+	}
+	for _, balancer := range config.BalancingRule {
+		if !referenced[balancer.Tag] {
+			issues = append(issues, &RouterIssue{Rule: -1, Message: "balancer " + balancer.Tag + " is not referenced by any rule"})
+		}
+	}
+
+	return issues, nil
+}
@@ -2,11 +2,24 @@ package conf_test
 
 import (
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	stdnet "net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/golang/protobuf/proto"
 
 	"v2ray.com/core/app/router"
+	"v2ray.com/core/common"
+	"v2ray.com/core/common/net"
+	"v2ray.com/core/common/platform"
+	"v2ray.com/ext/sysio"
 	. "v2ray.com/ext/tools/conf"
 )
 
@@ -21,7 +34,58 @@ func TestRouterConfig(t *testing.T) {
 		}
 	}
 
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("example.com\n10.0.0.0/8\n"))
+	}))
+	defer server.Close()
+	cacheDir, err := ioutil.TempDir("", "v2ray-ruleset")
+	common.Must(err)
+	defer os.RemoveAll(cacheDir)
+	defaultCacheDir := DefaultRulesetLoader.CacheDir
+	DefaultRulesetLoader.CacheDir = cacheDir
+	defer func() {
+		DefaultRulesetLoader.CacheDir = defaultCacheDir
+	}()
+
 	runMultiTestCase(t, []TestCase{
+		{
+			Input: `{
+				"rules": [
+					{
+						"type": "field",
+						"domain": ["ruleset:` + server.URL + `/list.txt"],
+						"ip": ["ruleset:` + server.URL + `/list.txt"],
+						"outboundTag": "direct"
+					}
+				]
+			}`,
+			Parser: createParser(),
+			Output: &router.Config{
+				Rule: []*router.RoutingRule{
+					{
+						Domain: []*router.Domain{
+							{
+								Type:  router.Domain_Domain,
+								Value: "example.com",
+							},
+						},
+						Geoip: []*router.GeoIP{
+							{
+								Cidr: []*router.CIDR{
+									{
+										Ip:     []byte{10, 0, 0, 0},
+										Prefix: 8,
+									},
+								},
+							},
+						},
+						TargetTag: &router.RoutingRule_Tag{
+							Tag: "direct",
+						},
+					},
+				},
+			},
+		},
 		{
 			Input: `{
 				"strategy": "rules",
@@ -231,3 +295,662 @@ func TestRouterConfig(t *testing.T) {
 		},
 	})
 }
+
+func TestRouterRuleExclusion(t *testing.T) {
+	createParser := func() func(string) (proto.Message, error) {
+		return func(s string) (proto.Message, error) {
+			config := new(RouterConfig)
+			if err := json.Unmarshal([]byte(s), config); err != nil {
+				return nil, err
+			}
+			return config.Build()
+		}
+	}
+
+	runMultiTestCase(t, []TestCase{
+		{
+			Input: `{
+				"rules": [
+					{
+						"type": "field",
+						"domain": [
+							"domain:example.com",
+							"qq.com",
+							"!domain:example.com"
+						],
+						"outboundTag": "direct"
+					},
+					{
+						"type": "field",
+						"ip": [
+							"10.0.0.0/8",
+							"!10.0.0.0/9"
+						],
+						"outboundTag": "test"
+					},
+					{
+						"type": "field",
+						"ip": [
+							"!0.0.0.0/1"
+						],
+						"outboundTag": "test"
+					}
+				]
+			}`,
+			Parser: createParser(),
+			Output: &router.Config{
+				Rule: []*router.RoutingRule{
+					{
+						Domain: []*router.Domain{
+							{
+								Type:  router.Domain_Plain,
+								Value: "qq.com",
+							},
+						},
+						TargetTag: &router.RoutingRule_Tag{
+							Tag: "direct",
+						},
+					},
+					{
+						Geoip: []*router.GeoIP{
+							{
+								Cidr: []*router.CIDR{
+									{
+										Ip:     []byte{10, 128, 0, 0},
+										Prefix: 9,
+									},
+								},
+							},
+						},
+						TargetTag: &router.RoutingRule_Tag{
+							Tag: "test",
+						},
+					},
+					{
+						Geoip: []*router.GeoIP{
+							{
+								Cidr: []*router.CIDR{
+									{
+										Ip:     []byte{128, 0, 0, 0},
+										Prefix: 1,
+									},
+									{
+										Ip:     []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+										Prefix: 0,
+									},
+								},
+							},
+						},
+						TargetTag: &router.RoutingRule_Tag{
+							Tag: "test",
+						},
+					},
+				},
+			},
+		},
+		{
+			Input: `{
+				"rules": [
+					{
+						"type": "field",
+						"domain": [
+							"domain:google.com",
+							"!full:mail.google.com"
+						],
+						"outboundTag": "direct"
+					}
+				]
+			}`,
+			Parser: createParser(),
+			Output: &router.Config{
+				Rule: []*router.RoutingRule{
+					{
+						Domain: []*router.Domain{
+							{
+								Type:  router.Domain_Domain,
+								Value: "google.com",
+							},
+						},
+						TargetTag: &router.RoutingRule_Tag{
+							Tag: "direct",
+						},
+					},
+				},
+			},
+		},
+	})
+}
+
+func TestRouterRulePortList(t *testing.T) {
+	createParser := func() func(string) (proto.Message, error) {
+		return func(s string) (proto.Message, error) {
+			config := new(RouterConfig)
+			if err := json.Unmarshal([]byte(s), config); err != nil {
+				return nil, err
+			}
+			return config.Build()
+		}
+	}
+
+	runMultiTestCase(t, []TestCase{
+		{
+			Input: `{
+				"rules": [
+					{
+						"type": "field",
+						"port": "53,8000-9000",
+						"outboundTag": "direct"
+					}
+				]
+			}`,
+			Parser: createParser(),
+			Output: &router.Config{
+				Rule: []*router.RoutingRule{
+					{
+						PortRange: &net.PortRange{From: 53, To: 53},
+						TargetTag: &router.RoutingRule_Tag{
+							Tag: "direct",
+						},
+					},
+					{
+						PortRange: &net.PortRange{From: 8000, To: 9000},
+						TargetTag: &router.RoutingRule_Tag{
+							Tag: "direct",
+						},
+					},
+				},
+			},
+		},
+	})
+}
+
+func TestAttributeMatchers(t *testing.T) {
+	domain := &router.Domain{
+		Type:  router.Domain_Domain,
+		Value: "example.com",
+		Attribute: []*router.Domain_Attribute{
+			{
+				Key: "cn",
+				TypedValue: &router.Domain_Attribute_BoolValue{
+					BoolValue: true,
+				},
+			},
+			{
+				Key: "level",
+				TypedValue: &router.Domain_Attribute_IntValue{
+					IntValue: 2,
+				},
+			},
+		},
+	}
+
+	testCases := []struct {
+		Matcher AttributeMatcher
+		Output  bool
+	}{
+		{Matcher: BooleanMatcher("cn"), Output: true},
+		{Matcher: NotMatcher{Matcher: BooleanMatcher("cn")}, Output: false},
+		{Matcher: AnyMatcher{BooleanMatcher("ads"), BooleanMatcher("cn")}, Output: true},
+		{Matcher: AnyMatcher{BooleanMatcher("ads"), NotMatcher{Matcher: BooleanMatcher("cn")}}, Output: false},
+		{Matcher: IntValueMatcher{Key: "level", Value: 2}, Output: true},
+		{Matcher: IntValueMatcher{Key: "level", Value: 3}, Output: false},
+		{Matcher: BoolValueMatcher{Key: "cn", Value: true}, Output: true},
+		{Matcher: BoolValueMatcher{Key: "level", Value: true}, Output: false},
+	}
+	for _, testCase := range testCases {
+		if r := testCase.Matcher.Match(domain); r != testCase.Output {
+			t.Error("unexpected result of ", testCase.Matcher, ": ", r)
+		}
+	}
+}
+
+func TestGeositeAttributeNegation(t *testing.T) {
+	geositePath := platform.GetAssetLocation("geosite.dat")
+	common.Must(sysio.CopyFile(geositePath, filepath.Join(os.Getenv("GOPATH"), "src", "v2ray.com", "core", "release", "config", "geosite.dat")))
+	defer func() {
+		os.Remove(geositePath)
+	}()
+
+	loadDomains := func(domains ...string) []*router.Domain {
+		rule, err := json.Marshal(map[string]interface{}{
+			"type":        "field",
+			"domain":      domains,
+			"outboundTag": "direct",
+		})
+		common.Must(err)
+		config := new(RouterConfig)
+		common.Must(json.Unmarshal([]byte(`{"rules": [`+string(rule)+`]}`), config))
+		routerConfig, err := config.Build()
+		common.Must(err)
+		return routerConfig.Rule[0].Domain
+	}
+	hasAttribute := func(d *router.Domain, key string) bool {
+		for _, attr := range d.Attribute {
+			if attr.Key == key {
+				return true
+			}
+		}
+		return false
+	}
+
+	all := loadDomains("geosite:google")
+	cn := loadDomains("geosite:google@cn")
+	notCN := loadDomains("geosite:google@!cn")
+	if len(cn) == 0 || len(notCN) == 0 {
+		t.Fatal("expected both cn and non-cn domains in geosite:google")
+	}
+	if len(notCN) >= len(all) {
+		t.Error("geosite:google@!cn doesn't filter any domain of geosite:google")
+	}
+	for _, d := range cn {
+		if !hasAttribute(d, "cn") {
+			t.Error("unexpected non-cn domain in geosite:google@cn: ", d.Value)
+		}
+	}
+	for _, d := range notCN {
+		if hasAttribute(d, "cn") {
+			t.Error("unexpected cn domain in geosite:google@!cn: ", d.Value)
+		}
+	}
+
+	excluded := loadDomains("geosite:google", "!geosite:google@cn")
+	if len(excluded) == 0 || len(excluded) >= len(all) {
+		t.Error("unexpected number of domains after excluding geosite:google@cn: ", len(excluded))
+	}
+	for _, d := range excluded {
+		if hasAttribute(d, "cn") {
+			t.Error("cn domain left after excluding geosite:google@cn: ", d.Value)
+		}
+	}
+}
+
+func matchDomainRule(rule string, domain string) bool {
+	switch {
+	case strings.HasPrefix(rule, "domain:"):
+		return domain == rule[7:] || strings.HasSuffix(domain, "."+rule[7:])
+	case strings.HasPrefix(rule, "full:"):
+		return domain == rule[5:]
+	default:
+		return strings.Contains(domain, rule)
+	}
+}
+
+func matchDomain(d *router.Domain, domain string) bool {
+	switch d.Type {
+	case router.Domain_Domain:
+		return domain == d.Value || strings.HasSuffix(domain, "."+d.Value)
+	case router.Domain_Full:
+		return domain == d.Value
+	case router.Domain_Plain:
+		return strings.Contains(domain, d.Value)
+	default:
+		panic("unexpected domain type")
+	}
+}
+
+func matchCIDR(geoipList []*router.GeoIP, ip stdnet.IP) bool {
+	for _, geoip := range geoipList {
+		for _, cidr := range geoip.Cidr {
+			ipNet := &stdnet.IPNet{
+				IP:   stdnet.IP(cidr.Ip),
+				Mask: stdnet.CIDRMask(int(cidr.Prefix), len(cidr.Ip)*8),
+			}
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestRouterConfigOptimization(t *testing.T) {
+	labels := []string{"a", "b", "ab", "v2ray", "com"}
+	randomDomain := func(r *rand.Rand) string {
+		parts := make([]string, 1+r.Intn(3))
+		for i := range parts {
+			parts[i] = labels[r.Intn(len(labels))]
+		}
+		return strings.Join(parts, ".")
+	}
+	randomIP := func(r *rand.Rand) stdnet.IP {
+		return stdnet.IP{10, 0, byte(r.Intn(4)), byte(r.Intn(256))}
+	}
+
+	// Each case is generated from its own fixed seed, so that a failure can be reproduced by the seed alone.
+	for seed := int64(1); seed <= 200; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		var domains, ips []string
+		for j := 0; j < 1+r.Intn(16); j++ {
+			switch r.Intn(3) {
+			case 0:
+				domains = append(domains, "domain:"+randomDomain(r))
+			case 1:
+				domains = append(domains, "full:"+randomDomain(r))
+			default:
+				domains = append(domains, labels[r.Intn(len(labels))])
+			}
+			// Host bits are cleared, as CIDRs with host bits set are rejected.
+			mask := stdnet.CIDRMask(22+r.Intn(11), 32)
+			network := stdnet.IPNet{IP: randomIP(r).Mask(mask), Mask: mask}
+			ips = append(ips, network.String())
+		}
+
+		rules, err := json.Marshal([]map[string]interface{}{
+			{"type": "field", "domain": domains, "outboundTag": "direct"},
+			{"type": "field", "ip": ips, "outboundTag": "direct"},
+		})
+		common.Must(err)
+		config := new(RouterConfig)
+		common.Must(json.Unmarshal([]byte(`{"rules":`+string(rules)+`}`), config))
+		pbConfig, err := config.Build()
+		if err != nil {
+			t.Fatal("seed ", seed, ": failed to build ", string(rules), ": ", err)
+		}
+
+		for j := 0; j < 200; j++ {
+			domain := randomDomain(r)
+			expected := false
+			for _, rule := range domains {
+				expected = expected || matchDomainRule(rule, domain)
+			}
+			actual := false
+			for _, d := range pbConfig.Rule[0].Domain {
+				actual = actual || matchDomain(d, domain)
+			}
+			if expected != actual {
+				t.Fatal("seed ", seed, ": domain ", domain, " matched differently by ", domains, " and ", pbConfig.Rule[0].Domain)
+			}
+
+			ip := randomIP(r)
+			expected = false
+			for _, s := range ips {
+				_, ipNet, err := stdnet.ParseCIDR(s)
+				common.Must(err)
+				expected = expected || ipNet.Contains(ip)
+			}
+			if actual := matchCIDR(pbConfig.Rule[1].Geoip, ip); expected != actual {
+				t.Fatal("seed ", seed, ": IP ", ip, " matched differently by ", ips, " and ", pbConfig.Rule[1].Geoip)
+			}
+		}
+	}
+}
+
+func TestRouterConfigCheck(t *testing.T) {
+	config := new(RouterConfig)
+	common.Must(json.Unmarshal([]byte(`{
+		"rules": [
+			{
+				"type": "field",
+				"domain": ["domain:example.com"],
+				"outboundTag": "direct"
+			},
+			{
+				"type": "field",
+				"domain": ["full:www.example.com", "qq.com"],
+				"outboundTag": "proxy"
+			},
+			{
+				"type": "field",
+				"domain": ["full:www.example.com"],
+				"port": "80",
+				"outboundTag": "proxy"
+			},
+			{
+				"type": "field",
+				"ip": ["10.0.0.0/8"],
+				"outboundTag": "direct"
+			},
+			{
+				"type": "field",
+				"ip": ["10.0.0.0/9", "10.128.0.0/9"],
+				"port": "53,80",
+				"balancerTag": "b1"
+			}
+		],
+		"balancers": [
+			{
+				"tag": "b1",
+				"selector": ["proxy"]
+			},
+			{
+				"tag": "b2",
+				"selector": ["proxy"]
+			}
+		]
+	}`), config))
+
+	issues, err := config.Check()
+	common.Must(err)
+
+	var actual []string
+	for _, issue := range issues {
+		actual = append(actual, issue.String())
+	}
+	expected := []string{
+		"rule 2: shadowed by rule 0",
+		"rule 4: shadowed by rule 3",
+		"balancer b2 is not referenced by any rule",
+	}
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Error("unexpected issues: ", actual)
+	}
+}
+
+func TestBalancingRule(t *testing.T) {
+	outboundTags := []string{"direct", "proxy-a", "proxy-b", "block"}
+
+	balancer := new(BalancingRule)
+	common.Must(json.Unmarshal([]byte(`{
+		"tag": "b1",
+		"selector": ["proxy-", "direct"]
+	}`), balancer))
+	common.Must(balancer.ValidateSelectors(outboundTags))
+	if r := strings.Join(balancer.SelectOutbounds(outboundTags), ","); r != "direct,proxy-a,proxy-b" {
+		t.Error("unexpected outbounds: ", r)
+	}
+
+	balancer = new(BalancingRule)
+	common.Must(json.Unmarshal([]byte(`{
+		"tag": "b2",
+		"selector": ["proxy-", "unknown"]
+	}`), balancer))
+	if err := balancer.ValidateSelectors(outboundTags); err == nil {
+		t.Error("expected error, but got nil")
+	}
+
+	balancer = new(BalancingRule)
+	common.Must(json.Unmarshal([]byte(`{"tag": "b3", "selector": ["proxy-"], "strategy": {"type": "random"}}`), balancer))
+	if _, err := balancer.Build(); err != nil {
+		t.Error("unexpected error: ", err)
+	}
+
+	unsupported := []struct {
+		Input string
+		Error string
+	}{
+		{
+			Input: `{"tag": "b4", "selector": ["proxy-"], "strategy": {"type": "leastLatency"}}`,
+			Error: "unsupported balancer strategy: leastLatency",
+		},
+		{
+			Input: `{"tag": "b5", "selector": ["proxy-"], "healthCheck": {"destination": "https://www.v2ray.com/"}}`,
+			Error: "unsupported balancer health check",
+		},
+	}
+	for _, testCase := range unsupported {
+		balancer := new(BalancingRule)
+		common.Must(json.Unmarshal([]byte(testCase.Input), balancer))
+		if _, err := balancer.Build(); err == nil || !strings.Contains(err.Error(), testCase.Error) {
+			t.Error("expected error ", testCase.Error, " for ", testCase.Input, ", but got ", err)
+		}
+	}
+}
+
+func TestParseIP(t *testing.T) {
+	testCases := []struct {
+		Input  string
+		Output *router.CIDR
+	}{
+		{
+			Input:  "10.0.0.0/8",
+			Output: &router.CIDR{Ip: []byte{10, 0, 0, 0}, Prefix: 8},
+		},
+		{
+			Input:  "::ffff:1.2.3.4",
+			Output: &router.CIDR{Ip: []byte{1, 2, 3, 4}, Prefix: 32},
+		},
+		{
+			Input:  "::ffff:1.2.3.0/120",
+			Output: &router.CIDR{Ip: []byte{1, 2, 3, 0}, Prefix: 24},
+		},
+	}
+	for _, testCase := range testCases {
+		cidr, err := ParseIP(testCase.Input)
+		common.Must(err)
+		if !proto.Equal(cidr, testCase.Output) {
+			t.Error("unexpected result of ", testCase.Input, ": ", cidr)
+		}
+	}
+
+	for _, input := range []string{"10.0.0.1/8", "::ffff:1.2.3.4/64", "10.0.0.0/33", "v2ray.com"} {
+		if _, err := ParseIP(input); err == nil {
+			t.Error("expected error for ", input, ", but got nil")
+		}
+	}
+}
+
+func TestParseIPRange(t *testing.T) {
+	cidrs, err := ParseIPRange("10.0.0.5-10.0.0.90")
+	common.Must(err)
+
+	var actual []string
+	for _, cidr := range cidrs {
+		actual = append(actual, fmt.Sprintf("%s/%d", stdnet.IP(cidr.Ip), cidr.Prefix))
+	}
+	expected := "10.0.0.5/32 10.0.0.6/31 10.0.0.8/29 10.0.0.16/28 10.0.0.32/27 10.0.0.64/28 10.0.0.80/29 10.0.0.88/31 10.0.0.90/32"
+	if r := strings.Join(actual, " "); r != expected {
+		t.Error("unexpected CIDRs: ", r)
+	}
+
+	for _, input := range []string{"10.0.0.90-10.0.0.5", "10.0.0.1-::1", "10.0.0.1-"} {
+		if _, err := ParseIPRange(input); err == nil {
+			t.Error("expected error for ", input, ", but got nil")
+		}
+	}
+}
+
+func TestRouterRulePriority(t *testing.T) {
+	config := new(RouterConfig)
+	common.Must(json.Unmarshal([]byte(`{
+		"rules": [
+			{
+				"type": "field",
+				"name": "team-a",
+				"ip": ["10.0.0.0/8"],
+				"outboundTag": "a"
+			},
+			{
+				"type": "field",
+				"name": "team-b",
+				"ip": ["10.0.0.0/8"],
+				"priority": -1,
+				"outboundTag": "b"
+			},
+			{
+				"type": "field",
+				"name": "disabled",
+				"ip": ["10.0.0.0/8"],
+				"priority": -2,
+				"enabled": false,
+				"outboundTag": "c"
+			},
+			{
+				"type": "field",
+				"ip": ["10.0.0.0/8"],
+				"outboundTag": "d"
+			}
+		]
+	}`), config))
+
+	routerConfig, err := config.Build()
+	common.Must(err)
+	var tags []string
+	for _, rule := range routerConfig.Rule {
+		tags = append(tags, rule.GetTag())
+	}
+	if r := strings.Join(tags, ","); r != "b,a,d" {
+		t.Error("unexpected rule order: ", r)
+	}
+
+	config = new(RouterConfig)
+	common.Must(json.Unmarshal([]byte(`{
+		"rules": [
+			{
+				"type": "field",
+				"name": "broken",
+				"ip": ["10.0.0.1/8"],
+				"outboundTag": "a"
+			}
+		]
+	}`), config))
+	if _, err := config.Build(); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Error("expected error with rule name, but got ", err)
+	}
+
+	config = new(RouterConfig)
+	common.Must(json.Unmarshal([]byte(`{
+		"rules": [
+			{"type": "field", "name": "dup", "ip": ["10.0.0.0/8"], "outboundTag": "a"},
+			{"type": "field", "name": "dup", "ip": ["10.0.0.0/8"], "outboundTag": "b"}
+		]
+	}`), config))
+	if _, err := config.Build(); err == nil {
+		t.Error("expected error for duplicated names, but got nil")
+	}
+}
+
+func TestDomainRuleNormalization(t *testing.T) {
+	buildDomains := func(domains ...string) ([]*router.Domain, error) {
+		rules, err := json.Marshal([]map[string]interface{}{
+			{"type": "field", "domain": domains, "outboundTag": "direct"},
+		})
+		common.Must(err)
+		config := new(RouterConfig)
+		common.Must(json.Unmarshal([]byte(`{"rules":`+string(rules)+`}`), config))
+		pbConfig, err := config.Build()
+		if err != nil {
+			return nil, err
+		}
+		return pbConfig.Rule[0].Domain, nil
+	}
+
+	domains, err := buildDomains("domain:例子.中国", "full:WWW.Example.COM.", "domain:_dmarc.v2ray.com", "Keyword", "regexp:^ads\\.")
+	common.Must(err)
+	expected := []*router.Domain{
+		{Type: router.Domain_Domain, Value: "xn--fsqu00a.xn--fiqs8s"},
+		{Type: router.Domain_Full, Value: "www.example.com"},
+		{Type: router.Domain_Domain, Value: "_dmarc.v2ray.com"},
+		{Type: router.Domain_Plain, Value: "keyword"},
+		{Type: router.Domain_Regex, Value: "^ads\\."},
+	}
+	if len(domains) != len(expected) {
+		t.Fatal("unexpected domains: ", domains)
+	}
+	for i := range expected {
+		if !proto.Equal(domains[i], expected[i]) {
+			t.Error("unexpected domain: ", domains[i])
+		}
+	}
+
+	for _, domain := range []string{"domain:bad domain.com", "full:a..b", "domain:-a.com", "full:", "regexp:^ab(c"} {
+		if _, err := buildDomains(domain); err == nil {
+			t.Error("expected error for ", domain, ", but got nil")
+		}
+	}
+	if _, err := buildDomains("regexp:a(b|c"); err == nil || !strings.Contains(err.Error(), "missing closing ) in `a(b|c` at offset 0") {
+		t.Error("expected error for missing paren, but got ", err)
+	}
+	if _, err := buildDomains("regexp:^ab[z-a]"); err == nil || !strings.Contains(err.Error(), "invalid character class range in `z-a` at offset 4") {
+		t.Error("expected error for invalid range, but got ", err)
+	}
+}
@@ -0,0 +1,197 @@
+package conf
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"v2ray.com/core/app/router"
+	"v2ray.com/core/common/buf"
+	"v2ray.com/core/common/platform"
+)
+
+// RulesetLoader fetches rule sets referenced by URL, and keeps the last good copy of each on disk.
+type RulesetLoader struct {
+	// CacheDir is the directory of cached rule sets.
+	CacheDir string
+	// MaxAge is the duration before a cached rule set is fetched again.
+	MaxAge time.Duration
+	Client *http.Client
+}
+
+// maxRulesetSize is the max size of a rule set in bytes.
+const maxRulesetSize = 32 * 1024 * 1024
+
+// defaultRulesetCacheDir returns the directory for rule sets in the cache directory of the user. The asset directory
+// is used if the user has no cache directory.
+func defaultRulesetCacheDir() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "v2ray", "ruleset")
+	}
+	return platform.GetAssetLocation("ruleset")
+}
+
+// DefaultRulesetLoader is the RulesetLoader used when building configs. Its cache directory and max age
+// can be changed by environment variables V2RAY_RULESET_CACHE and V2RAY_RULESET_MAXAGE (in seconds).
+var DefaultRulesetLoader = &RulesetLoader{
+	CacheDir: platform.NewEnvFlag("v2ray.ruleset.cache").GetValue(defaultRulesetCacheDir),
+	MaxAge:   time.Duration(platform.NewEnvFlag("v2ray.ruleset.maxage").GetValueAsInt(24*60*60)) * time.Second,
+	Client: &http.Client{
+		Timeout: 30 * time.Second,
+	},
+}
+
+// Ruleset is a list of domains and CIDRs.
+type Ruleset struct {
+	Domain []*router.Domain
+	Cidr   []*router.CIDR
+}
+
+func validateRulesetURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return newError("invalid rule set URL: ", rawURL).Base(err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return newError("rule set URL must be an HTTP(S) URL: ", rawURL)
+	}
+	return nil
+}
+
+func (l *RulesetLoader) cachePath(rawURL string) string {
+	hash := sha256.Sum256([]byte(rawURL))
+	return filepath.Join(l.CacheDir, hex.EncodeToString(hash[:])+".txt")
+}
+
+// Load returns the rule set at rawURL. A cached copy is used if it is younger than MaxAge.
+// If the rule set can't be fetched, the last good copy is used regardless of its age.
+func (l *RulesetLoader) Load(rawURL string) (*Ruleset, error) {
+	if err := validateRulesetURL(rawURL); err != nil {
+		return nil, err
+	}
+
+	path := l.cachePath(rawURL)
+	info, statErr := os.Stat(path)
+	if statErr == nil && time.Since(info.ModTime()) < l.MaxAge {
+		if ruleset, err := l.loadCache(path); err == nil {
+			return ruleset, nil
+		}
+	}
+
+	ruleset, err := l.Update(rawURL)
+	if err == nil {
+		return ruleset, nil
+	}
+	if statErr != nil {
+		return nil, err
+	}
+	cached, cacheErr := l.loadCache(path)
+	if cacheErr != nil {
+		return nil, err
+	}
+	newError("failed to update rule set ", rawURL, ", using the copy fetched at ", info.ModTime().Format(time.RFC3339)).Base(err).AtWarning().WriteToLog()
+	return cached, nil
+}
+
+func (l *RulesetLoader) loadCache(path string) (*Ruleset, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRuleset(content)
+}
+
+// Update fetches the rule set at rawURL, and replaces the cached copy if it is valid.
+func (l *RulesetLoader) Update(rawURL string) (*Ruleset, error) {
+	if err := validateRulesetURL(rawURL); err != nil {
+		return nil, err
+	}
+
+	resp, err := l.Client.Get(rawURL)
+	if err != nil {
+		return nil, newError("failed to fetch rule set ", rawURL).Base(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newError("unexpected HTTP status code ", resp.StatusCode, " of rule set ", rawURL)
+	}
+	content, err := buf.ReadAllToBytes(io.LimitReader(resp.Body, maxRulesetSize+1))
+	if err != nil {
+		return nil, newError("failed to read rule set ", rawURL).Base(err)
+	}
+	if len(content) > maxRulesetSize {
+		return nil, newError("rule set ", rawURL, " is larger than ", maxRulesetSize, " bytes")
+	}
+
+	ruleset, err := ParseRuleset(content)
+	if err != nil {
+		return nil, newError("invalid rule set ", rawURL).Base(err)
+	}
+
+	if err := os.MkdirAll(l.CacheDir, 0755); err != nil {
+		return nil, newError("failed to create rule set cache directory ", l.CacheDir).Base(err)
+	}
+	path := l.cachePath(rawURL)
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return nil, newError("failed to write rule set cache ", tmpPath).Base(err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return nil, newError("failed to write rule set cache ", path).Base(err)
+	}
+	return ruleset, nil
+}
+
+// ParseRuleset parses a newline separated list of domains and CIDRs. Empty lines and lines starting with "#" are ignored.
+// Domains may have "domain:", "full:", "regexp:" or "keyword:" prefixes. Domains without a prefix match their subdomains as well.
+func ParseRuleset(content []byte) (*Ruleset, error) {
+	ruleset := new(Ruleset)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "domain:"), strings.HasPrefix(line, "full:"), strings.HasPrefix(line, "regexp:"), strings.HasPrefix(line, "keyword:"):
+		case strings.Contains(line, "-") && net.ParseIP(line[:strings.Index(line, "-")]) != nil:
+			cidrs, err := ParseIPRange(line)
+			if err != nil {
+				return nil, newError("invalid IP range at line ", lineNum).Base(err)
+			}
+			ruleset.Cidr = append(ruleset.Cidr, cidrs...)
+			continue
+		case strings.Contains(line, "/") || net.ParseIP(line) != nil:
+			cidr, err := ParseIP(line)
+			if err != nil {
+				return nil, newError("invalid IP at line ", lineNum).Base(err)
+			}
+			ruleset.Cidr = append(ruleset.Cidr, cidr)
+			continue
+		default:
+			line = "domain:" + line
+		}
+
+		domains, err := parseDomainRule(line)
+		if err != nil {
+			return nil, newError("invalid domain at line ", lineNum).Base(err)
+		}
+		ruleset.Domain = append(ruleset.Domain, domains...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ruleset, nil
+}
@@ -0,0 +1,119 @@
+package conf_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"v2ray.com/core/app/router"
+	"v2ray.com/core/common"
+	. "v2ray.com/ext/tools/conf"
+)
+
+func TestParseRuleset(t *testing.T) {
+	ruleset, err := ParseRuleset([]byte(`
+# comment
+example.com
+full:www.v2ray.com
+regexp:^ads\.
+keyword:tracker
+10.0.0.0/8
+192.168.1.1
+`))
+	common.Must(err)
+
+	expected := &Ruleset{
+		Domain: []*router.Domain{
+			{Type: router.Domain_Domain, Value: "example.com"},
+			{Type: router.Domain_Full, Value: "www.v2ray.com"},
+			{Type: router.Domain_Regex, Value: "^ads\\."},
+			{Type: router.Domain_Plain, Value: "tracker"},
+		},
+		Cidr: []*router.CIDR{
+			{Ip: []byte{10, 0, 0, 0}, Prefix: 8},
+			{Ip: []byte{192, 168, 1, 1}, Prefix: 32},
+		},
+	}
+	if len(ruleset.Domain) != len(expected.Domain) || len(ruleset.Cidr) != len(expected.Cidr) {
+		t.Fatal("unexpected rule set: ", ruleset)
+	}
+	for i := range expected.Domain {
+		if !proto.Equal(ruleset.Domain[i], expected.Domain[i]) {
+			t.Error("unexpected domain: ", ruleset.Domain[i])
+		}
+	}
+	for i := range expected.Cidr {
+		if !proto.Equal(ruleset.Cidr[i], expected.Cidr[i]) {
+			t.Error("unexpected CIDR: ", ruleset.Cidr[i])
+		}
+	}
+
+	if _, err := ParseRuleset([]byte("example.com\n10.0.0.1/8\n")); err == nil {
+		t.Error("expected error, but got nil")
+	}
+}
+
+func TestRulesetLoader(t *testing.T) {
+	content := "example.com\n10.0.0.0/8\n"
+	status := http.StatusOK
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(status)
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	cacheDir, err := ioutil.TempDir("", "v2ray-ruleset")
+	common.Must(err)
+	defer os.RemoveAll(cacheDir)
+
+	loader := &RulesetLoader{
+		CacheDir: cacheDir,
+		MaxAge:   time.Hour,
+		Client:   server.Client(),
+	}
+	url := server.URL + "/list.txt"
+
+	ruleset, err := loader.Load(url)
+	common.Must(err)
+	if len(ruleset.Domain) != 1 || len(ruleset.Cidr) != 1 {
+		t.Error("unexpected rule set: ", ruleset)
+	}
+
+	// A fresh copy is served from cache.
+	_, err = loader.Load(url)
+	common.Must(err)
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Error("expected 1 request, but got ", n)
+	}
+
+	// An invalid update doesn't replace the last good copy.
+	content = "10.0.0.1/8\n"
+	if _, err := loader.Update(url); err == nil {
+		t.Error("expected error, but got nil")
+	}
+
+	// The last good copy is used when the server is unavailable.
+	loader.MaxAge = 0
+	status = http.StatusInternalServerError
+	ruleset, err = loader.Load(url)
+	common.Must(err)
+	if len(ruleset.Domain) != 1 || ruleset.Domain[0].Value != "example.com" {
+		t.Error("unexpected rule set: ", ruleset)
+	}
+
+	if _, err := loader.Load(server.URL + "/other.txt"); err == nil {
+		t.Error("expected error, but got nil")
+	}
+
+	if _, err := loader.Load("ftp://example.com/list.txt"); err == nil {
+		t.Error("expected error, but got nil")
+	}
+}
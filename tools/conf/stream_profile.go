@@ -0,0 +1,156 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+func decodeJSONObject(data []byte) (map[string]interface{}, error) {
+	obj := make(map[string]interface{})
+	if len(data) == 0 {
+		return obj, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// mergeJSON returns the result of applying override to base. Objects are merged field by field recursively,
+// while other values in override replace those in base. Keys are compared case-insensitively, as encoding/json
+// matches them to struct fields. Neither base nor override is modified.
+func mergeJSON(base, override map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(base)+len(override))
+	for k, v := range base {
+		result[k] = v
+	}
+	for k, v := range override {
+		var baseValue interface{}
+		for existing, value := range result {
+			if strings.EqualFold(existing, k) {
+				baseValue = value
+				delete(result, existing)
+			}
+		}
+		overrideObj, ok1 := v.(map[string]interface{})
+		baseObj, ok2 := baseValue.(map[string]interface{})
+		if ok1 && ok2 {
+			result[k] = mergeJSON(baseObj, overrideObj)
+		} else {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// popJSONField removes the field of obj whose key matches key case-insensitively, and returns its value.
+func popJSONField(obj map[string]interface{}, key string) (interface{}, bool) {
+	var value interface{}
+	found := false
+	for k, v := range obj {
+		if strings.EqualFold(k, key) {
+			value, found = v, true
+			delete(obj, k)
+		}
+	}
+	return value, found
+}
+
+// streamProfileResolver resolves stream settings that reference named profiles. A profile may inherit another profile
+// by its "profile" field, in the same way as stream settings do.
+type streamProfileResolver struct {
+	profiles map[string]json.RawMessage
+	resolved map[string]map[string]interface{}
+}
+
+func newStreamProfileResolver(profiles map[string]json.RawMessage) *streamProfileResolver {
+	return &streamProfileResolver{
+		profiles: profiles,
+		resolved: make(map[string]map[string]interface{}),
+	}
+}
+
+func (r *streamProfileResolver) resolve(name string, path []string) (map[string]interface{}, error) {
+	for i, p := range path {
+		if p == name {
+			return nil, newError("cyclic inheritance of stream profiles: ", strings.Join(append(path[i:], name), " -> "))
+		}
+	}
+	if obj, found := r.resolved[name]; found {
+		return obj, nil
+	}
+
+	raw, found := r.profiles[name]
+	if !found {
+		return nil, newError("stream profile not found: ", name)
+	}
+	obj, err := decodeJSONObject(raw)
+	if err != nil {
+		return nil, newError("invalid stream profile ", name).Base(err)
+	}
+	if parent, found := popJSONField(obj, "profile"); found {
+		parentName, ok := parent.(string)
+		if !ok {
+			return nil, newError("invalid parent of stream profile ", name)
+		}
+		base, err := r.resolve(parentName, append(path, name))
+		if err != nil {
+			return nil, err
+		}
+		obj = mergeJSON(base, obj)
+	}
+	r.resolved[name] = obj
+	return obj, nil
+}
+
+// validate resolves all profiles, so that broken profiles are reported even if they are not referenced.
+func (r *streamProfileResolver) validate() error {
+	names := make([]string, 0, len(r.profiles))
+	for name := range r.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		obj, err := r.resolve(name, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := streamConfigFromJSON(obj); err != nil {
+			return newError("invalid stream profile ", name).Base(err)
+		}
+	}
+	return nil
+}
+
+func streamConfigFromJSON(obj map[string]interface{}) (*StreamConfig, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	config := new(StreamConfig)
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// apply returns the stream settings with the referenced profile applied. Fields in s override those in the profile.
+func (r *streamProfileResolver) apply(s *StreamConfig) (*StreamConfig, error) {
+	if s == nil || len(s.Profile) == 0 {
+		return s, nil
+	}
+	base, err := r.resolve(s.Profile, nil)
+	if err != nil {
+		return nil, err
+	}
+	override, err := decodeJSONObject(s.raw)
+	if err != nil {
+		return nil, err
+	}
+	popJSONField(override, "profile")
+	return streamConfigFromJSON(mergeJSON(base, override))
+}
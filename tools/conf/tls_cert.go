@@ -0,0 +1,153 @@
+package conf
+
+import (
+	cryptotls "crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"time"
+
+	"v2ray.com/core/transport/internet/tls"
+)
+
+// defaultExpiryWarningDays is the default number of days before expiry that a certificate is warned about.
+const defaultExpiryWarningDays = 30
+
+// parseCertificates parses all certificates in PEM data. The first certificate is the leaf of the chain.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, newError("no certificate found in PEM data")
+	}
+	return certs, nil
+}
+
+func certificateName(cert *x509.Certificate) string {
+	if len(cert.Subject.CommonName) > 0 {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return cert.SerialNumber.String()
+}
+
+// validateCertificate checks that the certificate can be parsed, and its key matches the certificate.
+func validateCertificate(certificate *tls.Certificate) error {
+	chain, err := parseCertificates(certificate.Certificate)
+	if err != nil {
+		return newError("failed to parse certificate").Base(err)
+	}
+	if len(certificate.Key) > 0 {
+		if _, err := cryptotls.X509KeyPair(certificate.Certificate, certificate.Key); err != nil {
+			return newError("key doesn't match certificate ", certificateName(chain[0])).Base(err)
+		}
+	}
+
+	if certificate.Usage == tls.Certificate_AUTHORITY_ISSUE {
+		if len(certificate.Key) == 0 {
+			return newError("key of issuing certificate ", certificateName(chain[0]), " is not specified")
+		}
+		if !chain[0].IsCA {
+			return newError("issuing certificate ", certificateName(chain[0]), " is not a CA")
+		}
+	}
+	return nil
+}
+
+// checkCertificates warns about certificates that are expired or about to expire, and about certificates for
+// encipherment that are not issued by the certificates for verifying or issuing, if there are any. As certificates
+// may be replaced on disk or served to other clients, neither prevents the config from being built.
+func checkCertificates(certificates []*tls.Certificate, warningWindow time.Duration) error {
+	now := time.Now()
+	roots := x509.NewCertPool()
+	hasRoots := false
+	chains := make([][]*x509.Certificate, len(certificates))
+	for idx, certificate := range certificates {
+		chain, err := parseCertificates(certificate.Certificate)
+		if err != nil {
+			return err
+		}
+		chains[idx] = chain
+
+		leaf := chain[0]
+		switch {
+		case now.After(leaf.NotAfter):
+			newError("certificate ", certificateName(leaf), " expired at ", leaf.NotAfter.Format(time.RFC3339)).AtWarning().WriteToLog()
+		case now.Before(leaf.NotBefore):
+			newError("certificate ", certificateName(leaf), " is not valid until ", leaf.NotBefore.Format(time.RFC3339)).AtWarning().WriteToLog()
+		case leaf.NotAfter.Sub(now) < warningWindow:
+			newError("certificate ", certificateName(leaf), " expires at ", leaf.NotAfter.Format(time.RFC3339)).AtWarning().WriteToLog()
+		}
+
+		if certificate.Usage == tls.Certificate_AUTHORITY_VERIFY || certificate.Usage == tls.Certificate_AUTHORITY_ISSUE {
+			for _, cert := range chain {
+				roots.AddCert(cert)
+			}
+			hasRoots = true
+		}
+	}
+
+	if !hasRoots {
+		return nil
+	}
+	for idx, certificate := range certificates {
+		if certificate.Usage != tls.Certificate_ENCIPHERMENT {
+			continue
+		}
+		chain := chains[idx]
+		intermediates := x509.NewCertPool()
+		for _, cert := range chain[1:] {
+			intermediates.AddCert(cert)
+		}
+		if _, err := chain[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}); err != nil {
+			newError("certificate ", certificateName(chain[0]), " is not issued by any of the verify or issue certificates").Base(err).AtWarning().WriteToLog()
+		}
+	}
+	return nil
+}
+
+// checkServerName checks that the server name matches at least one of the leaf certificates for verifying,
+// as a certificate of a server is usually pinned that way. CA certificates are skipped.
+func checkServerName(serverName string, certificates []*tls.Certificate) error {
+	var leafs []*x509.Certificate
+	for _, certificate := range certificates {
+		if certificate.Usage != tls.Certificate_AUTHORITY_VERIFY {
+			continue
+		}
+		chain, err := parseCertificates(certificate.Certificate)
+		if err != nil {
+			return err
+		}
+		if !chain[0].IsCA {
+			leafs = append(leafs, chain[0])
+		}
+	}
+	if len(leafs) == 0 {
+		return nil
+	}
+	for _, leaf := range leafs {
+		if leaf.VerifyHostname(serverName) == nil {
+			return nil
+		}
+	}
+	return newError("server name ", serverName, " doesn't match any of the verify certificates")
+}
@@ -0,0 +1,172 @@
+package conf
+
+import (
+	cryptotls "crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"v2ray.com/core/common/protocol/tls/cert"
+	"v2ray.com/ext/sysio"
+)
+
+const (
+	defaultGeneratedCertValidityDays = 90
+	defaultGeneratedCertName         = "V2Ray Inc"
+)
+
+// TLSGenerateConfig is the config of a self-signed certificate that is saved to the certificate and key files of its
+// TLSCertConfig. The files are written by TLSCertConfig.GenerateFiles, such as by "v2ctl tlsgen", but not by Build.
+type TLSGenerateConfig struct {
+	Domains      StringList `json:"domains"`
+	CommonName   string     `json:"commonName"`
+	Organization string     `json:"organization"`
+	// Validity is the number of days that the certificate is valid for.
+	Validity uint32 `json:"validity"`
+	CA       bool   `json:"ca"`
+}
+
+func (c *TLSGenerateConfig) validity() time.Duration {
+	days := c.Validity
+	if days == 0 {
+		days = defaultGeneratedCertValidityDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// renewWindow returns how long before expiry a certificate is regenerated. It is a third of the validity,
+// but no more than the default expiry warning window.
+func (c *TLSGenerateConfig) renewWindow() time.Duration {
+	window := c.validity() / 3
+	if max := defaultExpiryWarningDays * 24 * time.Hour; window > max {
+		window = max
+	}
+	return window
+}
+
+func (c *TLSGenerateConfig) domains() ([]string, error) {
+	domains := make([]string, 0, len(c.Domains))
+	for _, domain := range c.Domains {
+		wildcard := strings.HasPrefix(domain, "*.")
+		normalized, err := normalizeDomain(strings.TrimPrefix(domain, "*."))
+		if err != nil {
+			return nil, err
+		}
+		if wildcard {
+			normalized = "*." + normalized
+		}
+		domains = append(domains, normalized)
+	}
+	return domains, nil
+}
+
+// generate returns a new certificate and its key in PEM.
+func (c *TLSGenerateConfig) generate() ([]byte, []byte, error) {
+	domains, err := c.domains()
+	if err != nil {
+		return nil, nil, err
+	}
+	commonName := c.CommonName
+	if len(commonName) == 0 {
+		commonName = defaultGeneratedCertName
+		if len(domains) > 0 {
+			commonName = domains[0]
+		}
+	}
+	organization := c.Organization
+	if len(organization) == 0 {
+		organization = defaultGeneratedCertName
+	}
+
+	opts := []cert.Option{
+		cert.NotAfter(time.Now().Add(c.validity())),
+		cert.CommonName(commonName),
+		cert.Organization(organization),
+	}
+	if c.CA {
+		opts = append(opts, cert.Authority(true))
+		opts = append(opts, cert.KeyUsage(x509.KeyUsageCertSign|x509.KeyUsageKeyEncipherment|x509.KeyUsageDigitalSignature))
+	}
+	if len(domains) > 0 {
+		opts = append(opts, cert.DNSNames(domains...))
+	}
+
+	certificate, err := cert.Generate(nil, opts...)
+	if err != nil {
+		return nil, nil, newError("failed to generate TLS certificate").Base(err)
+	}
+	certPEM, keyPEM := certificate.ToPEM()
+	return certPEM, keyPEM, nil
+}
+
+// reusable returns true if the existing certificate and key files match the config, and the certificate is not
+// near its expiry.
+func (c *TLSGenerateConfig) reusable(certFile, keyFile string) bool {
+	certPEM, err := sysio.ReadFile(certFile)
+	if err != nil {
+		return false
+	}
+	keyPEM, err := sysio.ReadFile(keyFile)
+	if err != nil {
+		return false
+	}
+	if _, err := cryptotls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return false
+	}
+	chain, err := parseCertificates(certPEM)
+	if err != nil {
+		return false
+	}
+	leaf := chain[0]
+	if time.Until(leaf.NotAfter) < c.renewWindow() || leaf.IsCA != c.CA {
+		return false
+	}
+	domains, err := c.domains()
+	if err != nil || len(domains) != len(leaf.DNSNames) {
+		return false
+	}
+	for idx, domain := range domains {
+		if leaf.DNSNames[idx] != domain {
+			return false
+		}
+	}
+	return true
+}
+
+func writeFileAtomic(path string, content []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	os.Remove(tmpPath)
+	if err := ioutil.WriteFile(tmpPath, content, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// ensure generates the certificate and key files, unless the existing ones can be reused.
+func (c *TLSGenerateConfig) ensure(certFile, keyFile string) error {
+	if c.reusable(certFile, keyFile) {
+		return nil
+	}
+	certPEM, keyPEM, err := c.generate()
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(keyFile, keyPEM, 0600); err != nil {
+		return newError("failed to write key file ", keyFile).Base(err)
+	}
+	if err := writeFileAtomic(certFile, certPEM, 0644); err != nil {
+		return newError("failed to write certificate file ", certFile).Base(err)
+	}
+	newError("generated TLS certificate ", certFile).AtInfo().WriteToLog()
+	return nil
+}
@@ -0,0 +1,181 @@
+package conf
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"strings"
+
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+	"v2ray.com/ext/sysio"
+)
+
+// wrongPassphrase returns the error of a key or a PKCS#12 file that can't be decrypted with the given passphrase.
+func wrongPassphrase(err error) error {
+	return newError("wrong passphrase").Base(err)
+}
+
+// resolveSecret returns the secret referenced by ref, in the form of "env:NAME" or "file:/path/to/secret".
+func resolveSecret(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, "env:"):
+		value, found := os.LookupEnv(ref[4:])
+		if !found {
+			return "", newError("environment variable ", ref[4:], " is not set")
+		}
+		return value, nil
+	case strings.HasPrefix(ref, "file:"):
+		content, err := sysio.ReadFile(ref[5:])
+		if err != nil {
+			return "", newError("failed to read secret file ", ref[5:]).Base(err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	default:
+		return "", newError("secret must be referenced by env:NAME or file:/path, but got ", ref)
+	}
+}
+
+func isPEM(data []byte) bool {
+	return bytes.Contains(data, []byte("-----BEGIN "))
+}
+
+// toPEMCertificates converts DER encoded certificates to PEM. PEM data is returned as is.
+func toPEMCertificates(data []byte) ([]byte, error) {
+	if isPEM(data) {
+		return data, nil
+	}
+	certs, err := x509.ParseCertificates(data)
+	if err != nil {
+		return nil, newError("neither PEM nor DER encoded certificate").Base(err)
+	}
+	var buffer bytes.Buffer
+	for _, cert := range certs {
+		if err := pem.Encode(&buffer, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+			return nil, err
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+func parsePrivateKey(der []byte) (crypto.PrivateKey, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, newError("unknown type of private key")
+}
+
+func encodePrivateKey(key crypto.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// toPEMKey converts a private key to unencrypted PEM. The key may be PEM or DER encoded, and may be encrypted
+// in PKCS#8 if passphrase is not empty. Legacy PEM encryption is rejected, as it is insecure by design.
+func toPEMKey(data []byte, passphrase string) ([]byte, error) {
+	der := data
+	encrypted := len(passphrase) > 0
+	if isPEM(data) {
+		var block *pem.Block
+		for rest := data; ; {
+			block, rest = pem.Decode(rest)
+			if block == nil || strings.HasSuffix(block.Type, "PRIVATE KEY") {
+				break
+			}
+		}
+		if block == nil {
+			return nil, newError("no private key found in PEM data")
+		}
+		if strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED") {
+			return nil, newError("legacy PEM encryption of private key is unsupported, convert the key to encrypted PKCS#8 by \"openssl pkcs8 -topk8\"")
+		}
+		encrypted = block.Type == "ENCRYPTED PRIVATE KEY"
+		if !encrypted {
+			if len(passphrase) > 0 {
+				return nil, newError("passphrase is specified, but key is not encrypted")
+			}
+			return data, nil
+		}
+		der = block.Bytes
+	}
+
+	if !encrypted {
+		key, err := parsePrivateKey(der)
+		if err != nil {
+			return nil, err
+		}
+		return encodePrivateKey(key)
+	}
+	if len(passphrase) == 0 {
+		return nil, newError("key is encrypted, but passphrase is not specified")
+	}
+	key, err := pkcs8.ParsePKCS8PrivateKey(der, []byte(passphrase))
+	if err != nil {
+		return nil, wrongPassphrase(err)
+	}
+	return encodePrivateKey(key)
+}
+
+func publicKeyEqual(cert *x509.Certificate, key crypto.PrivateKey) bool {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		pub, ok := cert.PublicKey.(*rsa.PublicKey)
+		return ok && pub.N.Cmp(key.N) == 0 && pub.E == key.E
+	case *ecdsa.PrivateKey:
+		pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+		return ok && pub.X.Cmp(key.X) == 0 && pub.Y.Cmp(key.Y) == 0
+	case ed25519.PrivateKey:
+		pub, ok := cert.PublicKey.(ed25519.PublicKey)
+		return ok && bytes.Equal(pub, key.Public().(ed25519.PublicKey))
+	default:
+		return false
+	}
+}
+
+// decodePKCS12 converts a PKCS#12 file to PEM encoded certificates and key. The certificate that matches the key
+// is placed first, followed by the rest of the chain. Both legacy and PBES2 (AES) encryption are supported.
+func decodePKCS12(data []byte, passphrase string) ([]byte, []byte, error) {
+	key, leaf, caCerts, err := pkcs12.DecodeChain(data, passphrase)
+	if err == pkcs12.ErrIncorrectPassword {
+		return nil, nil, wrongPassphrase(err)
+	}
+	if err != nil {
+		return nil, nil, newError("failed to decode PKCS#12 file").Base(err)
+	}
+	if key == nil || leaf == nil {
+		return nil, nil, newError("PKCS#12 file must contain a certificate and a private key")
+	}
+
+	certs := append([]*x509.Certificate{leaf}, caCerts...)
+	for i, cert := range certs {
+		if publicKeyEqual(cert, key) {
+			certs[0], certs[i] = certs[i], certs[0]
+			break
+		}
+	}
+	var certPEM bytes.Buffer
+	for _, cert := range certs {
+		if err := pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+			return nil, nil, err
+		}
+	}
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM.Bytes(), keyPEM, nil
+}
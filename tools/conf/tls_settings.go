@@ -0,0 +1,120 @@
+package conf
+
+import (
+	cryptotls "crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": cryptotls.VersionTLS10,
+	"1.1": cryptotls.VersionTLS11,
+	"1.2": cryptotls.VersionTLS12,
+	"1.3": cryptotls.VersionTLS13,
+}
+
+// tlsCurves maps lower case names of curves supported by crypto/tls to their canonical names.
+var tlsCurves = map[string]string{
+	"x25519": "X25519",
+	"p-256":  "P-256",
+	"p-384":  "P-384",
+	"p-521":  "P-521",
+	"p256":   "P-256",
+	"p384":   "P-384",
+	"p521":   "P-521",
+}
+
+// parseTLSVersion returns the normalized name of a TLS version, such as "1.2" for "TLS1.2", and its number.
+func parseTLSVersion(v string) (string, uint16, error) {
+	name := strings.TrimPrefix(strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(v)), "TLS"), "V")
+	version, found := tlsVersions[name]
+	if !found {
+		return "", 0, newError("unsupported TLS version: ", v)
+	}
+	return name, version, nil
+}
+
+// normalizeTLSVersions returns the normalized names of min and max versions. It is an error if min is greater than max.
+func normalizeTLSVersions(minVersion, maxVersion string) (string, string, error) {
+	var minName, maxName string
+	var min, max uint16
+	var err error
+	if len(minVersion) > 0 {
+		if minName, min, err = parseTLSVersion(minVersion); err != nil {
+			return "", "", err
+		}
+	}
+	if len(maxVersion) > 0 {
+		if maxName, max, err = parseTLSVersion(maxVersion); err != nil {
+			return "", "", err
+		}
+	}
+	if min > 0 && max > 0 && min > max {
+		return "", "", newError("min TLS version ", minVersion, " is greater than max version ", maxVersion)
+	}
+	return minName, maxName, nil
+}
+
+// findCipherSuite returns the cipher suite of the given name in crypto/tls, and whether it is insecure.
+func findCipherSuite(name string) (*cryptotls.CipherSuite, bool) {
+	for _, suite := range cryptotls.CipherSuites() {
+		if suite.Name == name {
+			return suite, false
+		}
+	}
+	for _, suite := range cryptotls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return suite, true
+		}
+	}
+	return nil, false
+}
+
+// validateCipherSuites checks the names of cipher suites against crypto/tls. Insecure cipher suites are only allowed
+// if allowInsecure is true. TLS 1.3 cipher suites are not configurable in crypto/tls.
+func validateCipherSuites(suites []string, allowInsecure bool) error {
+	seen := make(map[string]bool, len(suites))
+	for _, suite := range suites {
+		name := strings.ToUpper(suite)
+		cs, insecure := findCipherSuite(name)
+		if cs == nil {
+			return newError("unsupported cipher suite: ", suite)
+		}
+		if len(cs.SupportedVersions) == 1 && cs.SupportedVersions[0] == cryptotls.VersionTLS13 {
+			return newError("TLS 1.3 cipher suite ", suite, " is not configurable")
+		}
+		if insecure && !allowInsecure {
+			return newError("cipher suite ", suite, " is insecure, and allowInsecureCiphers is not set")
+		}
+		if seen[name] {
+			return newError("duplicated cipher suite: ", suite)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// parseCurves returns the canonical names of curves.
+func parseCurves(curves []string) ([]string, error) {
+	result := make([]string, 0, len(curves))
+	for _, curve := range curves {
+		name, found := tlsCurves[strings.ToLower(strings.TrimSpace(curve))]
+		if !found {
+			return nil, newError("unsupported curve: ", curve)
+		}
+		result = append(result, name)
+	}
+	return result, nil
+}
+
+// parseCertificateHash parses a SHA-256 hash in hex, optionally separated by colons, or in base64.
+func parseCertificateHash(s string) ([]byte, error) {
+	if h, err := hex.DecodeString(strings.Replace(s, ":", "", -1)); err == nil && len(h) == 32 {
+		return h, nil
+	}
+	if h, err := base64.StdEncoding.DecodeString(s); err == nil && len(h) == 32 {
+		return h, nil
+	}
+	return nil, newError("invalid SHA-256 hash of certificate: ", s)
+}
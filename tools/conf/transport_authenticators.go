@@ -103,15 +103,28 @@ func (v *HTTPAuthenticatorRequest) Build() (*http.RequestConfig, error) {
 	}
 
 	if len(v.Version) > 0 {
+		if !isHTTPVersion(v.Version) {
+			return nil, newError("invalid HTTP version: ", v.Version)
+		}
 		config.Version = &http.Version{Value: v.Version}
 	}
 
 	if len(v.Method) > 0 {
+		if !isHTTPToken(v.Method) {
+			return nil, newError("invalid HTTP method: ", v.Method)
+		}
 		config.Method = &http.Method{Value: v.Method}
 	}
 
 	if len(v.Path) > 0 {
-		config.Uri = append([]string(nil), (v.Path)...)
+		config.Uri = make([]string, 0, len(v.Path))
+		for _, path := range v.Path {
+			normalized, err := normalizeHTTPPath(path)
+			if err != nil {
+				return nil, err
+			}
+			config.Uri = append(config.Uri, normalized)
+		}
 	}
 
 	if len(v.Headers) > 0 {
@@ -122,6 +135,9 @@ func (v *HTTPAuthenticatorRequest) Build() (*http.RequestConfig, error) {
 			if value == nil {
 				return nil, newError("empty HTTP header value: " + key).AtError()
 			}
+			if err := checkHTTPHeader(key, *value); err != nil {
+				return nil, err
+			}
 			config.Header = append(config.Header, &http.Header{
 				Name:  key,
 				Value: append([]string(nil), (*value)...),
@@ -166,6 +182,9 @@ func (v *HTTPAuthenticatorResponse) Build() (*http.ResponseConfig, error) {
 	}
 
 	if len(v.Version) > 0 {
+		if !isHTTPVersion(v.Version) {
+			return nil, newError("invalid HTTP version: ", v.Version)
+		}
 		config.Version = &http.Version{Value: v.Version}
 	}
 
@@ -180,6 +199,12 @@ func (v *HTTPAuthenticatorResponse) Build() (*http.ResponseConfig, error) {
 		if len(v.Reason) > 0 {
 			config.Status.Reason = v.Reason
 		}
+		if !isHTTPStatusCode(config.Status.Code) {
+			return nil, newError("invalid HTTP status code: ", config.Status.Code)
+		}
+		if !isHTTPFieldValue(config.Status.Reason) {
+			return nil, newError("invalid HTTP reason phrase: ", config.Status.Reason)
+		}
 	}
 
 	if len(v.Headers) > 0 {
@@ -190,6 +215,9 @@ func (v *HTTPAuthenticatorResponse) Build() (*http.ResponseConfig, error) {
 			if value == nil {
 				return nil, newError("empty HTTP header value: " + key).AtError()
 			}
+			if err := checkHTTPHeader(key, *value); err != nil {
+				return nil, err
+			}
 			config.Header = append(config.Header, &http.Header{
 				Name:  key,
 				Value: append([]string(nil), (*value)...),
@@ -200,20 +228,64 @@ func (v *HTTPAuthenticatorResponse) Build() (*http.ResponseConfig, error) {
 	return config, nil
 }
 
+// withPreset returns the request with unspecified fields taken from the preset. Headers are merged by name.
+func (v *HTTPAuthenticatorRequest) withPreset(preset *HTTPAuthenticatorRequest) *HTTPAuthenticatorRequest {
+	request := *preset
+	if len(v.Version) > 0 {
+		request.Version = v.Version
+	}
+	if len(v.Method) > 0 {
+		request.Method = v.Method
+	}
+	if len(v.Path) > 0 {
+		request.Path = v.Path
+	}
+	request.Headers = mergeHTTPHeaders(preset.Headers, v.Headers)
+	return &request
+}
+
+// withPreset returns the response with unspecified fields taken from the preset. Headers are merged by name.
+func (v *HTTPAuthenticatorResponse) withPreset(preset *HTTPAuthenticatorResponse) *HTTPAuthenticatorResponse {
+	response := *preset
+	if len(v.Version) > 0 {
+		response.Version = v.Version
+	}
+	if len(v.Status) > 0 {
+		response.Status = v.Status
+	}
+	if len(v.Reason) > 0 {
+		response.Reason = v.Reason
+	}
+	response.Headers = mergeHTTPHeaders(preset.Headers, v.Headers)
+	return &response
+}
+
 type HTTPAuthenticator struct {
 	Request  HTTPAuthenticatorRequest  `json:"request"`
 	Response HTTPAuthenticatorResponse `json:"response"`
+	// Preset is the name of a preset in HTTPPresetFile or built-in presets. Fields in Request and Response override those in the preset.
+	Preset string `json:"preset"`
 }
 
 func (v *HTTPAuthenticator) Build() (proto.Message, error) {
+	request, response := &v.Request, &v.Response
+	if len(v.Preset) > 0 {
+		preset, err := loadHTTPPreset(v.Preset)
+		if err != nil {
+			return nil, err
+		}
+		request = v.Request.withPreset(&preset.Request)
+		response = v.Response.withPreset(&preset.Response)
+	}
+
 	config := new(http.Config)
-	requestConfig, err := v.Request.Build()
+	requestConfig, err := request.Build()
 	if err != nil {
 		return nil, err
 	}
 	config.Request = requestConfig
 
-	responseConfig, err := v.Response.Build()
+	responseConfig, err := response.Build()
 	if err != nil {
 		return nil, err
 	}
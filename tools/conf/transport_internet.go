@@ -2,13 +2,18 @@ package conf
 
 import (
 	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"v2ray.com/core/common/protocol"
 	"v2ray.com/core/common/serial"
 	"v2ray.com/core/transport/internet"
 	"v2ray.com/core/transport/internet/domainsocket"
+	httpheader "v2ray.com/core/transport/internet/headers/http"
 	"v2ray.com/core/transport/internet/http"
 	"v2ray.com/core/transport/internet/kcp"
 	"v2ray.com/core/transport/internet/quic"
@@ -43,10 +48,61 @@ type KCPConfig struct {
 	ReadBufferSize  *uint32         `json:"readBufferSize"`
 	WriteBufferSize *uint32         `json:"writeBufferSize"`
 	HeaderConfig    json.RawMessage `json:"header"`
+	// Seed enables obfuscation of mKCP packets, keyed by the seed. Both sides must use the same seed.
+	Seed *string `json:"seed"`
+	// Preset is the name of a tuning preset in kcpPresets. Fields specified explicitly override those in the preset.
+	Preset string `json:"preset"`
+}
+
+type kcpPreset struct {
+	mtu, tti, upCap, downCap, readBufferSize, writeBufferSize uint32
+	congestion                                                bool
+}
+
+var kcpPresets = map[string]kcpPreset{
+	"low-latency": {mtu: 1350, tti: 10, upCap: 20, downCap: 100, congestion: false, readBufferSize: 4, writeBufferSize: 4},
+	"balanced":    {mtu: 1350, tti: 30, upCap: 10, downCap: 50, congestion: false, readBufferSize: 2, writeBufferSize: 2},
+	"lossy-link":  {mtu: 1200, tti: 40, upCap: 5, downCap: 20, congestion: true, readBufferSize: 4, writeBufferSize: 4},
+}
+
+// maxKCPSize is the max of capacities and buffer sizes in MB, as they are converted to bytes in uint32.
+const maxKCPSize = 4095
+
+func pickUint32(v *uint32, preset uint32) *uint32 {
+	if v != nil {
+		return v
+	}
+	return &preset
+}
+
+// withPreset returns the config with unspecified fields taken from its preset.
+func (c *KCPConfig) withPreset() (*KCPConfig, error) {
+	if len(c.Preset) == 0 {
+		return c, nil
+	}
+	preset, found := kcpPresets[strings.ToLower(c.Preset)]
+	if !found {
+		return nil, newError("unknown mKCP preset: ", c.Preset)
+	}
+	config := *c
+	config.Mtu = pickUint32(c.Mtu, preset.mtu)
+	config.Tti = pickUint32(c.Tti, preset.tti)
+	config.UpCap = pickUint32(c.UpCap, preset.upCap)
+	config.DownCap = pickUint32(c.DownCap, preset.downCap)
+	config.ReadBufferSize = pickUint32(c.ReadBufferSize, preset.readBufferSize)
+	config.WriteBufferSize = pickUint32(c.WriteBufferSize, preset.writeBufferSize)
+	if c.Congestion == nil {
+		config.Congestion = &preset.congestion
+	}
+	return &config, nil
 }
 
 // Build implements Buildable.
 func (c *KCPConfig) Build() (proto.Message, error) {
+	c, err := c.withPreset()
+	if err != nil {
+		return nil, err
+	}
 	config := new(kcp.Config)
 
 	if c.Mtu != nil {
@@ -64,9 +120,15 @@ func (c *KCPConfig) Build() (proto.Message, error) {
 		config.Tti = &kcp.TTI{Value: tti}
 	}
 	if c.UpCap != nil {
+		if *c.UpCap > maxKCPSize {
+			return nil, newError("invalid mKCP uplink capacity: ", *c.UpCap).AtError()
+		}
 		config.UplinkCapacity = &kcp.UplinkCapacity{Value: *c.UpCap}
 	}
 	if c.DownCap != nil {
+		if *c.DownCap > maxKCPSize {
+			return nil, newError("invalid mKCP downlink capacity: ", *c.DownCap).AtError()
+		}
 		config.DownlinkCapacity = &kcp.DownlinkCapacity{Value: *c.DownCap}
 	}
 	if c.Congestion != nil {
@@ -74,6 +136,9 @@ func (c *KCPConfig) Build() (proto.Message, error) {
 	}
 	if c.ReadBufferSize != nil {
 		size := *c.ReadBufferSize
+		if size > maxKCPSize {
+			return nil, newError("invalid mKCP read buffer size: ", size).AtError()
+		}
 		if size > 0 {
 			config.ReadBuffer = &kcp.ReadBuffer{Size: size * 1024 * 1024}
 		} else {
@@ -82,6 +147,9 @@ func (c *KCPConfig) Build() (proto.Message, error) {
 	}
 	if c.WriteBufferSize != nil {
 		size := *c.WriteBufferSize
+		if size > maxKCPSize {
+			return nil, newError("invalid mKCP write buffer size: ", size).AtError()
+		}
 		if size > 0 {
 			config.WriteBuffer = &kcp.WriteBuffer{Size: size * 1024 * 1024}
 		} else {
@@ -99,6 +167,12 @@ func (c *KCPConfig) Build() (proto.Message, error) {
 		}
 		config.HeaderConfig = serial.ToTypedMessage(ts)
 	}
+	if c.Seed != nil {
+		if len(*c.Seed) == 0 {
+			return nil, newError("empty mKCP seed").AtError()
+		}
+		config.Seed = &kcp.EncryptionSeed{Seed: *c.Seed}
+	}
 
 	return config, nil
 }
@@ -129,6 +203,42 @@ type WebSocketConfig struct {
 	Path    string            `json:"path"`
 	Path2   string            `json:"Path"` // The key was misspelled. For backward compatibility, we have to keep track the old key.
 	Headers map[string]string `json:"headers"`
+	Host    string            `json:"host"`
+	// MaxEarlyData may also be specified by the "ed" parameter in the query of path, such as "/ws?ed=2048".
+	MaxEarlyData        int32  `json:"maxEarlyData"`
+	EarlyDataHeaderName string `json:"earlyDataHeaderName"`
+}
+
+// parseWebSocketPath returns the path with the early data parameter "ed" removed from its query, and the value of the parameter.
+// The order of other parameters is kept. A missing leading "/" is added, as the WebSocket transport does.
+func parseWebSocketPath(path string) (string, int32, error) {
+	path, err := normalizeHTTPPath(path)
+	if err != nil {
+		return "", 0, err
+	}
+	idx := strings.IndexByte(path, '?')
+	if idx < 0 {
+		return path, 0, nil
+	}
+	var earlyData int32
+	params := strings.Split(path[idx+1:], "&")
+	kept := params[:0]
+	for _, param := range params {
+		if !strings.HasPrefix(param, "ed=") {
+			kept = append(kept, param)
+			continue
+		}
+		value, err := strconv.ParseUint(param[3:], 10, 31)
+		if err != nil {
+			return "", 0, newError("invalid early data parameter in path: ", path).Base(err)
+		}
+		earlyData = int32(value)
+	}
+	path = path[:idx]
+	if len(kept) > 0 {
+		path += "?" + strings.Join(kept, "&")
+	}
+	return path, earlyData, nil
 }
 
 // Build implements Buildable.
@@ -137,33 +247,163 @@ func (c *WebSocketConfig) Build() (proto.Message, error) {
 	if len(path) == 0 && len(c.Path2) > 0 {
 		path = c.Path2
 	}
-	header := make([]*websocket.Header, 0, 32)
+	maxEarlyData := c.MaxEarlyData
+	if len(path) > 0 {
+		p, earlyData, err := parseWebSocketPath(path)
+		if err != nil {
+			return nil, err
+		}
+		if earlyData > 0 {
+			if maxEarlyData > 0 && maxEarlyData != earlyData {
+				return nil, newError("maxEarlyData ", maxEarlyData, " conflicts with early data parameter in path ", path)
+			}
+			maxEarlyData = earlyData
+		}
+		path = p
+	}
+	if maxEarlyData < 0 {
+		return nil, newError("maxEarlyData must not be negative, but got ", maxEarlyData)
+	}
+	if len(c.EarlyDataHeaderName) > 0 {
+		if maxEarlyData == 0 {
+			return nil, newError("earlyDataHeaderName is specified without maxEarlyData")
+		}
+		if !isHTTPToken(c.EarlyDataHeaderName) {
+			return nil, newError("invalid early data header name: ", c.EarlyDataHeaderName)
+		}
+	}
+
+	headers := make(map[string]string, len(c.Headers)+1)
 	for key, value := range c.Headers {
+		if err := validateHTTPHeader(key, []string{value}); err != nil {
+			return nil, err
+		}
+		headers[key] = value
+	}
+	if len(c.Host) > 0 {
+		host, err := normalizeHTTPHost(c.Host)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range c.Headers {
+			if strings.EqualFold(key, "Host") {
+				if value != c.Host && value != host {
+					return nil, newError("host ", c.Host, " conflicts with Host header ", value)
+				}
+				delete(headers, key)
+			}
+		}
+		headers["Host"] = host
+	}
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	header := make([]*websocket.Header, 0, len(keys))
+	for _, key := range keys {
 		header = append(header, &websocket.Header{
 			Key:   key,
-			Value: value,
+			Value: headers[key],
 		})
 	}
 
 	config := &websocket.Config{
-		Path:   path,
-		Header: header,
+		Path:                path,
+		Header:              header,
+		MaxEarlyData:        maxEarlyData,
+		EarlyDataHeaderName: c.EarlyDataHeaderName,
 	}
 	return config, nil
 }
 
+// HTTPPathList is a single path or a list of paths. Unlike StringList, a single path is not split by commas.
+// HTTP/2 transport only accepts one path, but the list form is kept for configs that already use it.
+type HTTPPathList []string
+
+func (v *HTTPPathList) UnmarshalJSON(data []byte) error {
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		*v = nil
+		if len(path) > 0 {
+			*v = HTTPPathList{path}
+		}
+		return nil
+	}
+	var paths []string
+	if err := json.Unmarshal(data, &paths); err != nil {
+		return newError("unknown format of paths: ", string(data))
+	}
+	*v = HTTPPathList(paths)
+	return nil
+}
+
 type HTTPConfig struct {
 	Host *StringList `json:"host"`
-	Path string      `json:"path"`
+	// Path is a single path, or a list of one path.
+	Path    HTTPPathList           `json:"path"`
+	Method  string                 `json:"method"`
+	Headers map[string]*StringList `json:"headers"`
+	// ReadIdleTimeout and HealthCheckTimeout are in seconds. A health check is sent after no data is read for
+	// ReadIdleTimeout, and the connection is closed if there is no response within HealthCheckTimeout.
+	ReadIdleTimeout    int32 `json:"readIdleTimeout"`
+	HealthCheckTimeout int32 `json:"healthCheckTimeout"`
 }
 
 func (c *HTTPConfig) Build() (proto.Message, error) {
-	config := &http.Config{
-		Path: c.Path,
+	config := new(http.Config)
+	if len(c.Path) > 1 {
+		return nil, newError("multiple paths are not supported by HTTP/2 transport: ", strings.Join(c.Path, ", "))
+	}
+	if len(c.Path) > 0 {
+		path, err := normalizeHTTPPath(c.Path[0])
+		if err != nil {
+			return nil, err
+		}
+		config.Path = path
 	}
 	if c.Host != nil {
-		config.Host = []string(*c.Host)
+		config.Host = make([]string, 0, len(*c.Host))
+		for _, host := range *c.Host {
+			normalized, err := normalizeHTTPHost(host)
+			if err != nil {
+				return nil, err
+			}
+			config.Host = append(config.Host, normalized)
+		}
 	}
+
+	if len(c.Method) > 0 {
+		if !isHTTPToken(c.Method) {
+			return nil, newError("invalid HTTP method: ", c.Method)
+		}
+		config.Method = c.Method
+	}
+	for _, key := range sortMapKeys(c.Headers) {
+		value := c.Headers[key]
+		if value == nil {
+			return nil, newError("empty HTTP header value: " + key)
+		}
+		if strings.EqualFold(key, "Host") {
+			return nil, newError("Host header must be specified by host")
+		}
+		if err := validateHTTPHeader(key, *value); err != nil {
+			return nil, err
+		}
+		config.Header = append(config.Header, &httpheader.Header{
+			Name:  key,
+			Value: append([]string(nil), (*value)...),
+		})
+	}
+
+	if c.ReadIdleTimeout < 0 || c.HealthCheckTimeout < 0 {
+		return nil, newError("readIdleTimeout and healthCheckTimeout must not be negative")
+	}
+	if c.HealthCheckTimeout > 0 && c.ReadIdleTimeout == 0 {
+		return nil, newError("healthCheckTimeout is specified without readIdleTimeout")
+	}
+	config.IdleTimeout = c.ReadIdleTimeout
+	config.HealthCheckTimeout = c.HealthCheckTimeout
 	return config, nil
 }
 
@@ -220,11 +460,15 @@ func (c *DomainSocketConfig) Build() (proto.Message, error) {
 }
 
 type TLSCertConfig struct {
-	CertFile string   `json:"certificateFile"`
-	CertStr  []string `json:"certificate"`
-	KeyFile  string   `json:"keyFile"`
-	KeyStr   []string `json:"key"`
-	Usage    string   `json:"usage"`
+	CertFile   string   `json:"certificateFile"`
+	CertStr    []string `json:"certificate"`
+	KeyFile    string   `json:"keyFile"`
+	KeyStr     []string `json:"key"`
+	Usage      string   `json:"usage"`
+	PKCS12File string   `json:"pkcs12File"`
+	// Passphrase is a reference to the passphrase of the key or the PKCS#12 file, in the form of "env:NAME" or "file:/path".
+	Passphrase string             `json:"passphrase"`
+	Generate   *TLSGenerateConfig `json:"generate"`
 }
 
 func readFileOrString(f string, s []string) ([]byte, error) {
@@ -237,21 +481,93 @@ func readFileOrString(f string, s []string) ([]byte, error) {
 	return nil, newError("both file and bytes are empty.")
 }
 
+func (c *TLSCertConfig) validateGenerate() error {
+	if len(c.CertFile) == 0 || len(c.KeyFile) == 0 {
+		return newError("certificateFile and keyFile must be specified to save the generated certificate")
+	}
+	if len(c.CertStr) > 0 || len(c.KeyStr) > 0 || len(c.PKCS12File) > 0 || len(c.Passphrase) > 0 {
+		return newError("generated certificate can't be used along with certificate, key, PKCS#12 file or passphrase")
+	}
+	if _, err := c.Generate.domains(); err != nil {
+		return newError("invalid domain of generated certificate").Base(err)
+	}
+	return nil
+}
+
+// GenerateFiles writes the certificate and key files of the generate settings, unless the existing files match the
+// settings and are not near expiry. Build never writes files, so they must be generated before the config is built.
+func (c *TLSCertConfig) GenerateFiles() error {
+	if c.Generate == nil {
+		return nil
+	}
+	if err := c.validateGenerate(); err != nil {
+		return err
+	}
+	return c.Generate.ensure(c.CertFile, c.KeyFile)
+}
+
 func (c *TLSCertConfig) Build() (*tls.Certificate, error) {
 	certificate := new(tls.Certificate)
 
-	cert, err := readFileOrString(c.CertFile, c.CertStr)
-	if err != nil {
-		return nil, newError("failed to parse certificate").Base(err)
+	if c.Generate != nil {
+		if err := c.validateGenerate(); err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(c.CertFile); os.IsNotExist(err) {
+			return nil, newError("generated certificate file ", c.CertFile, " doesn't exist, run \"v2ctl tlsgen < config.json\" to generate it")
+		}
+		if !c.Generate.reusable(c.CertFile, c.KeyFile) {
+			newError("generated certificate file ", c.CertFile, " doesn't match its generate settings or is near expiry, run \"v2ctl tlsgen < config.json\" to regenerate it").AtWarning().WriteToLog()
+		}
 	}
-	certificate.Certificate = cert
 
-	if len(c.KeyFile) > 0 || len(c.KeyStr) > 0 {
-		key, err := readFileOrString(c.KeyFile, c.KeyStr)
+	var passphrase string
+	if len(c.Passphrase) > 0 {
+		secret, err := resolveSecret(c.Passphrase)
 		if err != nil {
-			return nil, newError("failed to parse key").Base(err)
+			return nil, newError("failed to read passphrase").Base(err)
 		}
+		passphrase = secret
+	}
+
+	if len(c.PKCS12File) > 0 {
+		if len(c.CertFile) > 0 || len(c.CertStr) > 0 || len(c.KeyFile) > 0 || len(c.KeyStr) > 0 {
+			return nil, newError("PKCS#12 file can't be used along with certificate or key")
+		}
+		data, err := sysio.ReadFile(c.PKCS12File)
+		if err != nil {
+			return nil, newError("failed to read PKCS#12 file ", c.PKCS12File).Base(err)
+		}
+		cert, key, err := decodePKCS12(data, passphrase)
+		if err != nil {
+			return nil, newError("failed to parse PKCS#12 file ", c.PKCS12File).Base(err)
+		}
+		certificate.Certificate = cert
 		certificate.Key = key
+	} else {
+		cert, err := readFileOrString(c.CertFile, c.CertStr)
+		if err != nil {
+			return nil, newError("failed to parse certificate").Base(err)
+		}
+		cert, err = toPEMCertificates(cert)
+		if err != nil {
+			return nil, newError("failed to parse certificate").Base(err)
+		}
+		certificate.Certificate = cert
+
+		if len(c.KeyFile) > 0 || len(c.KeyStr) > 0 {
+			key, err := readFileOrString(c.KeyFile, c.KeyStr)
+			if err != nil {
+				return nil, newError("failed to parse key").Base(err)
+			}
+			key, err = toPEMKey(key, passphrase)
+			if err != nil {
+				return nil, newError("failed to parse key").Base(err)
+			}
+			certificate.Key = key
+		} else if len(passphrase) > 0 {
+			return nil, newError("passphrase is specified without key")
+		}
 	}
 
 	switch strings.ToLower(c.Usage) {
@@ -265,6 +581,10 @@ func (c *TLSCertConfig) Build() (*tls.Certificate, error) {
 		certificate.Usage = tls.Certificate_ENCIPHERMENT
 	}
 
+	if err := validateCertificate(certificate); err != nil {
+		return nil, err
+	}
+
 	return certificate, nil
 }
 
@@ -274,6 +594,15 @@ type TLSConfig struct {
 	Certs           []*TLSCertConfig `json:"certificates"`
 	ServerName      string           `json:"serverName"`
 	ALPN            *StringList      `json:"alpn"`
+	// ExpiryWarningDays is the number of days before expiry that a certificate is warned about.
+	ExpiryWarningDays uint32      `json:"expiryWarningDays"`
+	MinVersion        string      `json:"minVersion"`
+	MaxVersion        string      `json:"maxVersion"`
+	CipherSuites      *StringList `json:"cipherSuites"`
+	CurvePreferences  *StringList `json:"curvePreferences"`
+	DisableSystemRoot bool        `json:"disableSystemRoot"`
+	// PinnedPeerCertificateChainSha256 is a list of SHA-256 hashes of peer certificates, in hex or base64.
+	PinnedPeerCertificateChainSha256 *StringList `json:"pinnedPeerCertificateChainSha256"`
 }
 
 // Build implements Buildable.
@@ -287,6 +616,13 @@ func (c *TLSConfig) Build() (proto.Message, error) {
 		}
 		config.Certificate[idx] = cert
 	}
+	warningDays := c.ExpiryWarningDays
+	if warningDays == 0 {
+		warningDays = defaultExpiryWarningDays
+	}
+	if err := checkCertificates(config.Certificate, time.Duration(warningDays)*24*time.Hour); err != nil {
+		return nil, err
+	}
 	serverName := c.ServerName
 	config.AllowInsecure = c.Insecure
 	config.AllowInsecureCiphers = c.InsecureCiphers
@@ -296,6 +632,51 @@ func (c *TLSConfig) Build() (proto.Message, error) {
 	if c.ALPN != nil && len(*c.ALPN) > 0 {
 		config.NextProtocol = []string(*c.ALPN)
 	}
+
+	minVersion, maxVersion, err := normalizeTLSVersions(c.MinVersion, c.MaxVersion)
+	if err != nil {
+		return nil, err
+	}
+	config.MinVersion = minVersion
+	config.MaxVersion = maxVersion
+	if c.CipherSuites != nil && len(*c.CipherSuites) > 0 {
+		suites := make([]string, len(*c.CipherSuites))
+		for idx, suite := range *c.CipherSuites {
+			suites[idx] = strings.ToUpper(strings.TrimSpace(suite))
+		}
+		if err := validateCipherSuites(suites, c.InsecureCiphers); err != nil {
+			return nil, err
+		}
+		config.CipherSuites = strings.Join(suites, ":")
+	}
+	if c.CurvePreferences != nil && len(*c.CurvePreferences) > 0 {
+		curves, err := parseCurves(*c.CurvePreferences)
+		if err != nil {
+			return nil, err
+		}
+		config.CurvePreferences = curves
+	}
+	if c.DisableSystemRoot {
+		hasRoots := false
+		for _, cert := range config.Certificate {
+			if cert.Usage == tls.Certificate_AUTHORITY_VERIFY {
+				hasRoots = true
+			}
+		}
+		if !hasRoots && !c.Insecure {
+			return nil, newError("system root is disabled, but no certificate for verifying is specified")
+		}
+		config.DisableSystemRoot = true
+	}
+	if c.PinnedPeerCertificateChainSha256 != nil {
+		for _, s := range *c.PinnedPeerCertificateChainSha256 {
+			hash, err := parseCertificateHash(strings.TrimSpace(s))
+			if err != nil {
+				return nil, err
+			}
+			config.PinnedPeerCertificateChainSha256 = append(config.PinnedPeerCertificateChainSha256, hash)
+		}
+	}
 	return config, nil
 }
 
@@ -322,9 +703,72 @@ func (p TransportProtocol) Build() (string, error) {
 }
 
 type SocketConfig struct {
-	Mark   int32  `json:"mark"`
-	TFO    *bool  `json:"tcpFastOpen"`
-	TProxy string `json:"tproxy"`
+	Mark      int32  `json:"mark"`
+	TFO       *bool  `json:"tcpFastOpen"`
+	TProxy    string `json:"tproxy"`
+	Interface string `json:"interface"`
+	// TCPKeepAliveIdle and TCPKeepAliveInterval are in seconds. 0 for system default.
+	TCPKeepAliveIdle     int32  `json:"tcpKeepAliveIdle"`
+	TCPKeepAliveInterval int32  `json:"tcpKeepAliveInterval"`
+	TCPCongestion        string `json:"tcpCongestion"`
+	ReusePort            bool   `json:"reusePort"`
+	// V6Only sets IPV6_V6ONLY if true. If false or not specified, the system default is kept.
+	V6Only *bool `json:"v6only"`
+	// DSCP and TOS are two ways of setting the same IP header field. At most one of them may be specified.
+	DSCP *int32 `json:"dscp"`
+	TOS  *int32 `json:"tos"`
+}
+
+const (
+	// maxInterfaceNameLength is IFNAMSIZ on Linux, excluding the trailing NUL.
+	maxInterfaceNameLength = 15
+	// maxTCPKeepAlive is the maximum of TCP_KEEPIDLE and TCP_KEEPINTVL on Linux.
+	maxTCPKeepAlive = 32767
+	// maxTCPCongestionLength is TCP_CA_NAME_MAX on Linux, excluding the trailing NUL.
+	maxTCPCongestionLength = 15
+)
+
+func validateInterfaceName(name string) error {
+	if len(name) > maxInterfaceNameLength || name == "." || name == ".." {
+		return newError("invalid interface name: ", name)
+	}
+	for _, c := range name {
+		if c == '/' || c == ':' || c <= ' ' || c > '~' {
+			return newError("invalid interface name: ", name)
+		}
+	}
+	return nil
+}
+
+func validateTCPCongestion(name string) error {
+	if len(name) > maxTCPCongestionLength {
+		return newError("invalid TCP congestion algorithm: ", name)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return newError("invalid TCP congestion algorithm: ", name)
+		}
+	}
+	return nil
+}
+
+func (c *SocketConfig) tos() (int32, error) {
+	switch {
+	case c.DSCP != nil && c.TOS != nil:
+		return 0, newError("dscp and tos can't be specified at the same time")
+	case c.DSCP != nil:
+		if *c.DSCP < 0 || *c.DSCP > 63 {
+			return 0, newError("DSCP must be within [0, 63], but got ", *c.DSCP)
+		}
+		return *c.DSCP << 2, nil
+	case c.TOS != nil:
+		if *c.TOS < 0 || *c.TOS > 255 {
+			return 0, newError("TOS must be within [0, 255], but got ", *c.TOS)
+		}
+		return *c.TOS, nil
+	default:
+		return 0, nil
+	}
 }
 
 func (c *SocketConfig) Build() (*internet.SocketConfig, error) {
@@ -346,10 +790,39 @@ func (c *SocketConfig) Build() (*internet.SocketConfig, error) {
 		tproxy = internet.SocketConfig_Off
 	}
 
+	if len(c.Interface) > 0 {
+		if err := validateInterfaceName(c.Interface); err != nil {
+			return nil, err
+		}
+	}
+	if c.TCPKeepAliveIdle < 0 || c.TCPKeepAliveIdle > maxTCPKeepAlive {
+		return nil, newError("tcpKeepAliveIdle must be within [0, ", maxTCPKeepAlive, "], but got ", c.TCPKeepAliveIdle)
+	}
+	if c.TCPKeepAliveInterval < 0 || c.TCPKeepAliveInterval > maxTCPKeepAlive {
+		return nil, newError("tcpKeepAliveInterval must be within [0, ", maxTCPKeepAlive, "], but got ", c.TCPKeepAliveInterval)
+	}
+	congestion := strings.ToLower(c.TCPCongestion)
+	if len(congestion) > 0 {
+		if err := validateTCPCongestion(congestion); err != nil {
+			return nil, err
+		}
+	}
+	tos, err := c.tos()
+	if err != nil {
+		return nil, err
+	}
+
 	return &internet.SocketConfig{
-		Mark:   c.Mark,
-		Tfo:    tfoSettings,
-		Tproxy: tproxy,
+		Mark:                 c.Mark,
+		Tfo:                  tfoSettings,
+		Tproxy:               tproxy,
+		BindToDevice:         c.Interface,
+		TcpKeepAliveIdle:     c.TCPKeepAliveIdle,
+		TcpKeepAliveInterval: c.TCPKeepAliveInterval,
+		TcpCongestion:        congestion,
+		ReusePort:            c.ReusePort,
+		V6Only:               c.V6Only != nil && *c.V6Only,
+		Tos:                  tos,
 	}, nil
 }
 
@@ -364,10 +837,32 @@ type StreamConfig struct {
 	DSSettings     *DomainSocketConfig `json:"dsSettings"`
 	QUICSettings   *QUICConfig         `json:"quicSettings"`
 	SocketSettings *SocketConfig       `json:"sockopt"`
+	Profile        string              `json:"profile"`
+
+	raw json.RawMessage
 }
 
-// Build implements Buildable.
+// UnmarshalJSON implements json.Unmarshaler. Stream settings may also be the name of a stream profile.
+func (c *StreamConfig) UnmarshalJSON(data []byte) error {
+	var profile string
+	if err := json.Unmarshal(data, &profile); err == nil {
+		*c = StreamConfig{Profile: profile}
+		return nil
+	}
+
+	type rawStreamConfig StreamConfig
+	if err := json.Unmarshal(data, (*rawStreamConfig)(c)); err != nil {
+		return err
+	}
+	c.raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+// Build implements Buildable. Stream profiles must have been applied, as they are only known to the whole config.
 func (c *StreamConfig) Build() (*internet.StreamConfig, error) {
+	if len(c.Profile) > 0 {
+		return nil, newError("stream profile ", c.Profile, " is not resolved")
+	}
 	config := &internet.StreamConfig{
 		ProtocolName: "tcp",
 	}
@@ -2,9 +2,12 @@ package conf_test
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/golang/protobuf/proto"
+	"v2ray.com/core/common"
 	"v2ray.com/core/common/protocol"
 	"v2ray.com/core/common/serial"
 	"v2ray.com/core/transport"
@@ -12,6 +15,7 @@ import (
 	"v2ray.com/core/transport/internet/headers/http"
 	"v2ray.com/core/transport/internet/headers/noop"
 	"v2ray.com/core/transport/internet/headers/tls"
+	httptransport "v2ray.com/core/transport/internet/http"
 	"v2ray.com/core/transport/internet/kcp"
 	"v2ray.com/core/transport/internet/quic"
 	"v2ray.com/core/transport/internet/tcp"
@@ -42,6 +46,72 @@ func TestSocketConfig(t *testing.T) {
 				Tfo:  internet.SocketConfig_Enable,
 			},
 		},
+		{
+			Input: `{
+				"interface": "eth0",
+				"tcpKeepAliveIdle": 300,
+				"tcpKeepAliveInterval": 30,
+				"tcpCongestion": "BBR",
+				"reusePort": true,
+				"v6only": true,
+				"dscp": 46
+			}`,
+			Parser: createParser(),
+			Output: &internet.SocketConfig{
+				BindToDevice:         "eth0",
+				TcpKeepAliveIdle:     300,
+				TcpKeepAliveInterval: 30,
+				TcpCongestion:        "bbr",
+				ReusePort:            true,
+				V6Only:               true,
+				Tos:                  184,
+			},
+		},
+		{
+			Input:  `{"v6only": false}`,
+			Parser: createParser(),
+			Output: &internet.SocketConfig{},
+		},
+		{
+			Input:  `{"interface": "a-very-long-interface"}`,
+			Parser: createParser(),
+			Error:  "invalid interface name",
+		},
+		{
+			Input:  `{"interface": "eth/0"}`,
+			Parser: createParser(),
+			Error:  "invalid interface name",
+		},
+		{
+			Input:  `{"tcpKeepAliveIdle": -1}`,
+			Parser: createParser(),
+			Error:  "tcpKeepAliveIdle must be within",
+		},
+		{
+			Input:  `{"tcpKeepAliveInterval": 40000}`,
+			Parser: createParser(),
+			Error:  "tcpKeepAliveInterval must be within",
+		},
+		{
+			Input:  `{"tcpCongestion": "bbr;cubic"}`,
+			Parser: createParser(),
+			Error:  "invalid TCP congestion algorithm",
+		},
+		{
+			Input:  `{"dscp": 64}`,
+			Parser: createParser(),
+			Error:  "DSCP must be within",
+		},
+		{
+			Input:  `{"tos": 256}`,
+			Parser: createParser(),
+			Error:  "TOS must be within",
+		},
+		{
+			Input:  `{"dscp": 46, "tos": 184}`,
+			Parser: createParser(),
+			Error:  "dscp and tos can't be specified at the same time",
+		},
 	})
 }
 
@@ -167,3 +237,453 @@ func TestTransportConfig(t *testing.T) {
 		},
 	})
 }
+
+func TestHTTPHeaderPreset(t *testing.T) {
+	presetFile, err := ioutil.TempFile("", "v2ray-http-presets")
+	common.Must(err)
+	defer os.Remove(presetFile.Name())
+	common.Must2(presetFile.WriteString(`{
+		"custom": {
+			"request": {
+				"method": "POST",
+				"path": ["/upload", "/api/v1"],
+				"headers": {
+					"Host": ["a.example.com", "b.example.com"],
+					"Content-Type": ["application/json"]
+				}
+			},
+			"response": {
+				"status": "201",
+				"reason": "Created"
+			}
+		}
+	}`))
+	common.Must(presetFile.Close())
+
+	defaultFile := HTTPPresetFile
+	HTTPPresetFile = presetFile.Name()
+	defer func() { HTTPPresetFile = defaultFile }()
+
+	createParser := func() func(string) (proto.Message, error) {
+		return func(s string) (proto.Message, error) {
+			config := new(HTTPAuthenticator)
+			if err := json.Unmarshal([]byte(s), config); err != nil {
+				return nil, err
+			}
+			return config.Build()
+		}
+	}
+
+	runMultiTestCase(t, []TestCase{
+		{
+			Input: `{
+				"type": "http",
+				"preset": "custom",
+				"request": {
+					"headers": {
+						"host": ["c.example.com"]
+					}
+				}
+			}`,
+			Parser: createParser(),
+			Output: &http.Config{
+				Request: &http.RequestConfig{
+					Method: &http.Method{Value: "POST"},
+					Uri:    []string{"/upload", "/api/v1"},
+					Header: []*http.Header{
+						{Name: "Content-Type", Value: []string{"application/json"}},
+						{Name: "host", Value: []string{"c.example.com"}},
+					},
+				},
+				Response: &http.ResponseConfig{
+					Status: &http.Status{Code: "201", Reason: "Created"},
+					Header: []*http.Header{
+						{Name: "Content-Type", Value: []string{"application/octet-stream", "video/mpeg"}},
+						{Name: "Transfer-Encoding", Value: []string{"chunked"}},
+						{Name: "Connection", Value: []string{"keep-alive"}},
+						{Name: "Pragma", Value: []string{"no-cache"}},
+						{Name: "Cache-Control", Value: []string{"private", "no-cache"}},
+					},
+				},
+			},
+		},
+	})
+
+	for _, preset := range []string{"default", "browser", "video", "download"} {
+		config := &HTTPAuthenticator{Preset: preset}
+		common.Must2(config.Build())
+	}
+
+	runMultiTestCase(t, []TestCase{
+		{
+			Input: `{
+				"request": {
+					"version": "1.0",
+					"method": "PROPFIND",
+					"path": ["index.html"],
+					"headers": {"X Custom": ["value"]}
+				},
+				"response": {"status": "299", "reason": "Whatever"}
+			}`,
+			Parser: createParser(),
+			Output: &http.Config{
+				Request: &http.RequestConfig{
+					Version: &http.Version{Value: "1.0"},
+					Method:  &http.Method{Value: "PROPFIND"},
+					Uri:     []string{"/index.html"},
+					Header: []*http.Header{
+						{Name: "X Custom", Value: []string{"value"}},
+					},
+				},
+				Response: &http.ResponseConfig{
+					Status: &http.Status{Code: "299", Reason: "Whatever"},
+					Header: []*http.Header{
+						{Name: "Content-Type", Value: []string{"application/octet-stream", "video/mpeg"}},
+						{Name: "Transfer-Encoding", Value: []string{"chunked"}},
+						{Name: "Connection", Value: []string{"keep-alive"}},
+						{Name: "Pragma", Value: []string{"no-cache"}},
+						{Name: "Cache-Control", Value: []string{"private", "no-cache"}},
+					},
+				},
+			},
+		},
+		{
+			Input:  `{"preset": "unknown"}`,
+			Parser: createParser(),
+			Error:  "HTTP header preset not found: unknown",
+		},
+		{
+			Input:  `{"request": {"method": "GET /admin HTTP/1.1\r\n"}}`,
+			Parser: createParser(),
+			Error:  "invalid HTTP method",
+		},
+		{
+			Input:  `{"request": {"version": "1.1\r\nX-Injected: 1"}}`,
+			Parser: createParser(),
+			Error:  "invalid HTTP version",
+		},
+		{
+			Input:  `{"request": {"path": ["/index.html HTTP/1.1"]}}`,
+			Parser: createParser(),
+			Error:  "invalid character in HTTP path",
+		},
+		{
+			Input:  `{"request": {"headers": {"X-Injected: 1\r\nHost": ["value"]}}}`,
+			Parser: createParser(),
+			Error:  "invalid HTTP header name",
+		},
+		{
+			Input:  `{"request": {"headers": {"Host": ["v2ray.com\r\nX-Injected: 1"]}}}`,
+			Parser: createParser(),
+			Error:  "invalid value of HTTP header Host",
+		},
+		{
+			Input:  `{"response": {"status": "200\r\n"}}`,
+			Parser: createParser(),
+			Error:  "invalid HTTP status code",
+		},
+		{
+			Input:  `{"response": {"status": "200", "reason": "OK\n"}}`,
+			Parser: createParser(),
+			Error:  "invalid HTTP reason phrase",
+		},
+		{
+			Input:  `{"request": {"version": "HTTP/1.1"}}`,
+			Parser: createParser(),
+			Error:  "invalid HTTP version",
+		},
+		{
+			Input:  `{"request": {"method": "GET(1)"}}`,
+			Parser: createParser(),
+			Error:  "invalid HTTP method",
+		},
+		{
+			Input:  `{"response": {"status": "2000"}}`,
+			Parser: createParser(),
+			Error:  "invalid HTTP status code",
+		},
+	})
+
+	absolute := &HTTPAuthenticatorRequest{Path: StringList{"http://www.v2ray.com/", "HTTPS://www.v2ray.com/index.html"}}
+	request, err := absolute.Build()
+	common.Must(err)
+	if request.Uri[0] != "http://www.v2ray.com/" || request.Uri[1] != "HTTPS://www.v2ray.com/index.html" {
+		t.Error("unexpected request targets: ", request.Uri)
+	}
+}
+
+func TestWebSocketConfig(t *testing.T) {
+	createParser := func() func(string) (proto.Message, error) {
+		return func(s string) (proto.Message, error) {
+			config := new(WebSocketConfig)
+			if err := json.Unmarshal([]byte(s), config); err != nil {
+				return nil, err
+			}
+			return config.Build()
+		}
+	}
+
+	runMultiTestCase(t, []TestCase{
+		{
+			Input: `{
+				"path": "/ws?a=1&ed=2048&b=2",
+				"host": "WWW.V2Ray.com",
+				"earlyDataHeaderName": "Sec-WebSocket-Protocol",
+				"headers": {
+					"X-Forwarded-For": "127.0.0.1",
+					"User-Agent": "Mozilla/5.0",
+					"host": "WWW.V2Ray.com"
+				}
+			}`,
+			Parser: createParser(),
+			Output: &websocket.Config{
+				Path: "/ws?a=1&b=2",
+				Header: []*websocket.Header{
+					{Key: "Host", Value: "www.v2ray.com"},
+					{Key: "User-Agent", Value: "Mozilla/5.0"},
+					{Key: "X-Forwarded-For", Value: "127.0.0.1"},
+				},
+				MaxEarlyData:        2048,
+				EarlyDataHeaderName: "Sec-WebSocket-Protocol",
+			},
+		},
+		{
+			Input: `{
+				"path": "/ws",
+				"maxEarlyData": 1024
+			}`,
+			Parser: createParser(),
+			Output: &websocket.Config{
+				Path:         "/ws",
+				Header:       []*websocket.Header{},
+				MaxEarlyData: 1024,
+			},
+		},
+		{
+			Input: `{
+				"path": "ws"
+			}`,
+			Parser: createParser(),
+			Output: &websocket.Config{
+				Path:   "/ws",
+				Header: []*websocket.Header{},
+			},
+		},
+		{
+			Input:  `{"path": "/w s"}`,
+			Parser: createParser(),
+			Error:  "invalid character in HTTP path",
+		},
+		{
+			Input:  `{"path": "/ws?ed=abc"}`,
+			Parser: createParser(),
+			Error:  "invalid early data parameter in path",
+		},
+		{
+			Input:  `{"path": "/ws?ed=2048", "maxEarlyData": 1024}`,
+			Parser: createParser(),
+			Error:  "conflicts with early data parameter in path",
+		},
+		{
+			Input:  `{"maxEarlyData": -1}`,
+			Parser: createParser(),
+			Error:  "maxEarlyData must not be negative",
+		},
+		{
+			Input:  `{"earlyDataHeaderName": "Sec-WebSocket-Protocol"}`,
+			Parser: createParser(),
+			Error:  "earlyDataHeaderName is specified without maxEarlyData",
+		},
+		{
+			Input:  `{"maxEarlyData": 1024, "earlyDataHeaderName": "Bad Header"}`,
+			Parser: createParser(),
+			Error:  "invalid early data header name",
+		},
+		{
+			Input:  `{"host": "-invalid-.com"}`,
+			Parser: createParser(),
+			Error:  "invalid HTTP host",
+		},
+		{
+			Input:  `{"host": "v2ray.com", "headers": {"Host": "example.com"}}`,
+			Parser: createParser(),
+			Error:  "conflicts with Host header",
+		},
+		{
+			Input:  `{"headers": {"X-Bad\r\nName": "value"}}`,
+			Parser: createParser(),
+			Error:  "invalid HTTP header name",
+		},
+		{
+			Input:  `{"headers": {"X-Name": "bad\r\nvalue"}}`,
+			Parser: createParser(),
+			Error:  "invalid value of HTTP header X-Name",
+		},
+	})
+}
+
+func TestHTTPConfig(t *testing.T) {
+	createParser := func() func(string) (proto.Message, error) {
+		return func(s string) (proto.Message, error) {
+			config := new(HTTPConfig)
+			if err := json.Unmarshal([]byte(s), config); err != nil {
+				return nil, err
+			}
+			return config.Build()
+		}
+	}
+
+	runMultiTestCase(t, []TestCase{
+		{
+			Input: `{
+				"host": ["V2Ray.com", "www.v2ray.com:8443"],
+				"path": "/a,b"
+			}`,
+			Parser: createParser(),
+			Output: &httptransport.Config{
+				Host: []string{"v2ray.com", "www.v2ray.com:8443"},
+				Path: "/a,b",
+			},
+		},
+		{
+			Input: `{
+				"path": ["/upload"],
+				"method": "POST",
+				"headers": {
+					"X-Cdn-Key": ["abc"],
+					"Accept": ["*/*"]
+				},
+				"readIdleTimeout": 30,
+				"healthCheckTimeout": 10
+			}`,
+			Parser: createParser(),
+			Output: &httptransport.Config{
+				Path:   "/upload",
+				Method: "POST",
+				Header: []*http.Header{
+					{Name: "Accept", Value: []string{"*/*"}},
+					{Name: "X-Cdn-Key", Value: []string{"abc"}},
+				},
+				IdleTimeout:        30,
+				HealthCheckTimeout: 10,
+			},
+		},
+		{
+			Input: `{
+				"path": "b"
+			}`,
+			Parser: createParser(),
+			Output: &httptransport.Config{
+				Path: "/b",
+			},
+		},
+		{
+			Input:  `{"path": ["/a", "/b"]}`,
+			Parser: createParser(),
+			Error:  "multiple paths are not supported by HTTP/2 transport",
+		},
+		{
+			Input:  `{"host": ["bad host"]}`,
+			Parser: createParser(),
+			Error:  "invalid HTTP host",
+		},
+		{
+			Input:  `{"host": ["v2ray.com:99999"]}`,
+			Parser: createParser(),
+			Error:  "invalid port in HTTP host",
+		},
+		{
+			Input:  `{"path": ["/b c"]}`,
+			Parser: createParser(),
+			Error:  "invalid character in HTTP path",
+		},
+		{
+			Input:  `{"method": "P UT"}`,
+			Parser: createParser(),
+			Error:  "invalid HTTP method",
+		},
+		{
+			Input:  `{"headers": {"Host": ["v2ray.com"]}}`,
+			Parser: createParser(),
+			Error:  "Host header must be specified by host",
+		},
+		{
+			Input:  `{"headers": {"X-Name": ["bad\nvalue"]}}`,
+			Parser: createParser(),
+			Error:  "invalid value of HTTP header X-Name",
+		},
+		{
+			Input:  `{"readIdleTimeout": -1}`,
+			Parser: createParser(),
+			Error:  "readIdleTimeout and healthCheckTimeout must not be negative",
+		},
+		{
+			Input:  `{"healthCheckTimeout": 10}`,
+			Parser: createParser(),
+			Error:  "healthCheckTimeout is specified without readIdleTimeout",
+		},
+	})
+}
+
+func TestKCPConfig(t *testing.T) {
+	createParser := func() func(string) (proto.Message, error) {
+		return func(s string) (proto.Message, error) {
+			config := new(KCPConfig)
+			if err := json.Unmarshal([]byte(s), config); err != nil {
+				return nil, err
+			}
+			return config.Build()
+		}
+	}
+
+	runMultiTestCase(t, []TestCase{
+		{
+			Input: `{
+				"preset": "lossy-link",
+				"tti": 20,
+				"seed": "v2ray"
+			}`,
+			Parser: createParser(),
+			Output: &kcp.Config{
+				Mtu:              &kcp.MTU{Value: 1200},
+				Tti:              &kcp.TTI{Value: 20},
+				UplinkCapacity:   &kcp.UplinkCapacity{Value: 5},
+				DownlinkCapacity: &kcp.DownlinkCapacity{Value: 20},
+				Congestion:       true,
+				ReadBuffer:       &kcp.ReadBuffer{Size: 4 * 1024 * 1024},
+				WriteBuffer:      &kcp.WriteBuffer{Size: 4 * 1024 * 1024},
+				Seed:             &kcp.EncryptionSeed{Seed: "v2ray"},
+			},
+		},
+		{
+			Input:  `{"preset": "unknown"}`,
+			Parser: createParser(),
+			Error:  "unknown mKCP preset: unknown",
+		},
+		{
+			Input:  `{"seed": ""}`,
+			Parser: createParser(),
+			Error:  "empty mKCP seed",
+		},
+		{
+			Input:  `{"uplinkCapacity": 5000}`,
+			Parser: createParser(),
+			Error:  "invalid mKCP uplink capacity",
+		},
+		{
+			Input:  `{"downlinkCapacity": 5000}`,
+			Parser: createParser(),
+			Error:  "invalid mKCP downlink capacity",
+		},
+		{
+			Input:  `{"readBufferSize": 5000}`,
+			Parser: createParser(),
+			Error:  "invalid mKCP read buffer size",
+		},
+		{
+			Input:  `{"writeBufferSize": 5000}`,
+			Parser: createParser(),
+			Error:  "invalid mKCP write buffer size",
+		},
+	})
+}
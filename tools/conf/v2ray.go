@@ -2,13 +2,17 @@ package conf
 
 import (
 	"encoding/json"
+	"strconv"
 	"strings"
 
+	"github.com/golang/protobuf/proto"
 	"v2ray.com/core"
 	"v2ray.com/core/app/dispatcher"
 	"v2ray.com/core/app/proxyman"
+	"v2ray.com/core/app/router"
 	"v2ray.com/core/app/stats"
 	"v2ray.com/core/common/serial"
+	"v2ray.com/core/transport/internet/tls"
 )
 
 var (
@@ -121,7 +125,8 @@ func (c *InboundDetourAllocationConfig) Build() (*proxyman.AllocationStrategy, e
 
 type InboundDetourConfig struct {
 	Protocol       string                         `json:"protocol"`
-	PortRange      *PortRange                     `json:"port"`
+	PortRange      *PortRange                     `json:"-"`
+	PortList       *PortList                      `json:"port"`
 	ListenOn       *Address                       `json:"listen"`
 	Settings       *json.RawMessage               `json:"settings"`
 	Tag            string                         `json:"tag"`
@@ -131,14 +136,69 @@ type InboundDetourConfig struct {
 	SniffingConfig *SniffingConfig                `json:"sniffing"`
 }
 
-// Build implements Buildable.
+// UnmarshalJSON implements encoding/json.Unmarshaler.UnmarshalJSON. PortRange is set if "port" is a single range.
+func (c *InboundDetourConfig) UnmarshalJSON(data []byte) error {
+	type rawInboundDetourConfig InboundDetourConfig
+	raw := (*rawInboundDetourConfig)(c)
+	if err := json.Unmarshal(data, raw); err != nil {
+		return err
+	}
+	c.PortRange = nil
+	if c.PortList != nil && len(c.PortList.Range) == 1 {
+		c.PortRange = &c.PortList.Range[0]
+	}
+	return nil
+}
+
+func (c *InboundDetourConfig) portRanges() []PortRange {
+	if c.PortList != nil && len(c.PortList.Range) > 1 {
+		return c.PortList.Range
+	}
+	if c.PortRange != nil {
+		return []PortRange{*c.PortRange}
+	}
+	if c.PortList != nil {
+		return c.PortList.Range
+	}
+	return nil
+}
+
+// HandlerTags returns the tags of the handlers that this inbound is built into by BuildAll. An inbound listening on
+// multiple port ranges is built into one handler for each range, and handler tags are suffixed with the index of the
+// range, as the inbound manager requires tags to be unique. Routing rules are rewritten to match all of these tags,
+// but traffic stats and the handler API see each handler under its own tag.
+func (c *InboundDetourConfig) HandlerTags() []string {
+	ranges := c.portRanges()
+	if len(ranges) <= 1 || len(c.Tag) == 0 {
+		return []string{c.Tag}
+	}
+	tags := make([]string, len(ranges))
+	for idx := range tags {
+		tags[idx] = c.Tag + "-" + strconv.Itoa(idx)
+	}
+	return tags
+}
+
+// Build implements Buildable. It fails if the inbound listens on multiple port ranges, which must be built by BuildAll.
 func (c *InboundDetourConfig) Build() (*core.InboundHandlerConfig, error) {
+	if len(c.portRanges()) > 1 {
+		return nil, newError("inbound ", c.Tag, " listens on multiple port ranges, and can't be built into a single handler")
+	}
+	handlers, err := c.BuildAll()
+	if err != nil {
+		return nil, err
+	}
+	return handlers[0], nil
+}
+
+// BuildAll builds the inbound into one handler for each port range. See HandlerTags for the tags of the handlers.
+func (c *InboundDetourConfig) BuildAll() ([]*core.InboundHandlerConfig, error) {
 	receiverSettings := &proxyman.ReceiverConfig{}
 
-	if c.PortRange == nil {
+	ranges := c.portRanges()
+	if len(ranges) == 0 {
 		return nil, newError("port range not specified in InboundDetour.")
 	}
-	receiverSettings.PortRange = c.PortRange.Build()
 
 	if c.ListenOn != nil {
 		if c.ListenOn.Family().IsDomain() {
@@ -151,9 +211,11 @@ func (c *InboundDetourConfig) Build() (*core.InboundHandlerConfig, error) {
 		if c.Allocation.Concurrency != nil && c.Allocation.Strategy == "random" {
 			concurrency = int(*c.Allocation.Concurrency)
 		}
-		portRange := int(c.PortRange.To - c.PortRange.From + 1)
-		if concurrency >= 0 && concurrency >= portRange {
-			return nil, newError("not enough ports. concurrency = ", concurrency, " ports: ", c.PortRange.From, " - ", c.PortRange.To)
+		for _, pr := range ranges {
+			portRange := int(pr.To - pr.From + 1)
+			if concurrency >= 0 && concurrency >= portRange {
+				return nil, newError("not enough ports. concurrency = ", concurrency, " ports: ", pr.From, " - ", pr.To)
+			}
 		}
 
 		as, err := c.Allocation.Build()
@@ -200,11 +262,19 @@ func (c *InboundDetourConfig) Build() (*core.InboundHandlerConfig, error) {
 		return nil, err
 	}
 
-	return &core.InboundHandlerConfig{
-		Tag:              c.Tag,
-		ReceiverSettings: serial.ToTypedMessage(receiverSettings),
-		ProxySettings:    serial.ToTypedMessage(ts),
-	}, nil
+	tags := c.HandlerTags()
+	handlers := make([]*core.InboundHandlerConfig, 0, len(ranges))
+	for idx := range ranges {
+		rs := proto.Clone(receiverSettings).(*proxyman.ReceiverConfig)
+		rs.PortRange = ranges[idx].Build()
+		handlers = append(handlers, &core.InboundHandlerConfig{
+			Tag:              tags[idx],
+			ReceiverSettings: serial.ToTypedMessage(rs),
+			ProxySettings:    serial.ToTypedMessage(ts),
+		})
+	}
+
+	return handlers, nil
 }
 
 type OutboundDetourConfig struct {
@@ -234,6 +304,17 @@ func (c *OutboundDetourConfig) Build() (*core.OutboundHandlerConfig, error) {
 		if err != nil {
 			return nil, err
 		}
+		for _, tm := range ss.SecuritySettings {
+			instance, err := tm.GetInstance()
+			if err != nil {
+				return nil, err
+			}
+			if tlsConfig, ok := instance.(*tls.Config); ok && len(tlsConfig.ServerName) > 0 {
+				if err := checkServerName(tlsConfig.ServerName, tlsConfig.Certificate); err != nil {
+					return nil, newError("invalid TLS settings of outbound ", c.Tag).Base(err)
+				}
+			}
+		}
 		senderSettings.StreamSettings = ss
 	}
 
@@ -279,21 +360,22 @@ func (c *StatsConfig) Build() (*stats.Config, error) {
 }
 
 type Config struct {
-	Port            uint16                 `json:"port"` // Port of this Point server. Deprecated.
-	LogConfig       *LogConfig             `json:"log"`
-	RouterConfig    *RouterConfig          `json:"routing"`
-	DNSConfig       *DnsConfig             `json:"dns"`
-	InboundConfigs  []InboundDetourConfig  `json:"inbounds"`
-	OutboundConfigs []OutboundDetourConfig `json:"outbounds"`
-	InboundConfig   *InboundDetourConfig   `json:"inbound"`        // Deprecated.
-	OutboundConfig  *OutboundDetourConfig  `json:"outbound"`       // Deprecated.
-	InboundDetours  []InboundDetourConfig  `json:"inboundDetour"`  // Deprecated.
-	OutboundDetours []OutboundDetourConfig `json:"outboundDetour"` // Deprecated.
-	Transport       *TransportConfig       `json:"transport"`
-	Policy          *PolicyConfig          `json:"policy"`
-	Api             *ApiConfig             `json:"api"`
-	Stats           *StatsConfig           `json:"stats"`
-	Reverse         *ReverseConfig         `json:"reverse"`
+	Port            uint16                     `json:"port"` // Port of this Point server. Deprecated.
+	LogConfig       *LogConfig                 `json:"log"`
+	RouterConfig    *RouterConfig              `json:"routing"`
+	DNSConfig       *DnsConfig                 `json:"dns"`
+	InboundConfigs  []InboundDetourConfig      `json:"inbounds"`
+	OutboundConfigs []OutboundDetourConfig     `json:"outbounds"`
+	InboundConfig   *InboundDetourConfig       `json:"inbound"`        // Deprecated.
+	OutboundConfig  *OutboundDetourConfig      `json:"outbound"`       // Deprecated.
+	InboundDetours  []InboundDetourConfig      `json:"inboundDetour"`  // Deprecated.
+	OutboundDetours []OutboundDetourConfig     `json:"outboundDetour"` // Deprecated.
+	Transport       *TransportConfig           `json:"transport"`
+	Policy          *PolicyConfig              `json:"policy"`
+	Api             *ApiConfig                 `json:"api"`
+	Stats           *StatsConfig               `json:"stats"`
+	Reverse         *ReverseConfig             `json:"reverse"`
+	StreamProfiles  map[string]json.RawMessage `json:"streamProfiles"`
 }
 
 func applyTransportConfig(s *StreamConfig, t *TransportConfig) {
@@ -312,6 +394,118 @@ func applyTransportConfig(s *StreamConfig, t *TransportConfig) {
 	if s.DSSettings == nil {
 		s.DSSettings = t.DSConfig
 	}
+	if s.QUICSettings == nil {
+		s.QUICSettings = t.QUICConfig
+	}
+}
+
+func (c *Config) getInbounds() []InboundDetourConfig {
+	var inbounds []InboundDetourConfig
+
+	if c.InboundConfig != nil {
+		inbounds = append(inbounds, *c.InboundConfig)
+	}
+
+	if len(c.InboundDetours) > 0 {
+		inbounds = append(inbounds, c.InboundDetours...)
+	}
+
+	if len(c.InboundConfigs) > 0 {
+		inbounds = append(inbounds, c.InboundConfigs...)
+	}
+
+	// Backward compatibility.
+	if len(inbounds) > 0 && len(inbounds[0].portRanges()) == 0 && c.Port > 0 {
+		inbounds[0].PortRange = &PortRange{
+			From: uint32(c.Port),
+			To:   uint32(c.Port),
+		}
+	}
+
+	return inbounds
+}
+
+// expandInboundTags replaces the inbound tags in routing rules with the tags of all handlers built from
+// the inbounds, so that rules keep matching inbounds that are built into multiple handlers.
+func expandInboundTags(config *router.Config, inbounds []InboundDetourConfig) {
+	expanded := make(map[string][]string)
+	for idx := range inbounds {
+		if tags := inbounds[idx].HandlerTags(); len(tags) > 1 {
+			expanded[inbounds[idx].Tag] = tags
+		}
+	}
+	if len(expanded) == 0 {
+		return
+	}
+	for _, rule := range config.Rule {
+		var inboundTags []string
+		for _, tag := range rule.InboundTag {
+			if tags, found := expanded[tag]; found {
+				inboundTags = append(inboundTags, tags...)
+			} else {
+				inboundTags = append(inboundTags, tag)
+			}
+		}
+		rule.InboundTag = inboundTags
+	}
+}
+
+func (c *Config) getOutbounds() []OutboundDetourConfig {
+	var outbounds []OutboundDetourConfig
+
+	if c.OutboundConfig != nil {
+		outbounds = append(outbounds, *c.OutboundConfig)
+	}
+
+	if len(c.OutboundDetours) > 0 {
+		outbounds = append(outbounds, c.OutboundDetours...)
+	}
+
+	if len(c.OutboundConfigs) > 0 {
+		outbounds = append(outbounds, c.OutboundConfigs...)
+	}
+
+	return outbounds
+}
+
+// OutboundTags returns the tags of all outbounds, in the order they are defined.
+func (c *Config) OutboundTags() []string {
+	var tags []string
+	for _, outbound := range c.getOutbounds() {
+		if len(outbound.Tag) > 0 {
+			tags = append(tags, outbound.Tag)
+		}
+	}
+	return tags
+}
+
+// GenerateCertificates writes the files of all TLS certificates of inbounds and outbounds that have generate settings.
+// See TLSCertConfig.GenerateFiles.
+func (c *Config) GenerateCertificates() error {
+	var streamSettings []*StreamConfig
+	for _, inbound := range c.getInbounds() {
+		streamSettings = append(streamSettings, inbound.StreamSetting)
+	}
+	for _, outbound := range c.getOutbounds() {
+		streamSettings = append(streamSettings, outbound.StreamSetting)
+	}
+
+	streamProfiles := newStreamProfileResolver(c.StreamProfiles)
+	for _, s := range streamSettings {
+		s, err := streamProfiles.apply(s)
+		if err != nil {
+			return err
+		}
+		if s == nil || s.TLSSettings == nil {
+			continue
+		}
+		for _, certConfig := range s.TLSSettings.Certs {
+			if err := certConfig.GenerateFiles(); err != nil {
+				return newError("failed to generate certificate ", certConfig.CertFile).Base(err)
+			}
+		}
+	}
+	return nil
 }
 
 // Build implements Buildable.
@@ -346,11 +540,21 @@ func (c *Config) Build() (*core.Config, error) {
 		config.App = append(config.App, serial.ToTypedMessage(DefaultLogConfig()))
 	}
 
+	var routerConfig *router.Config
+	var routerOrigins []int
 	if c.RouterConfig != nil {
-		routerConfig, err := c.RouterConfig.Build()
+		outboundTags := c.OutboundTags()
+		for _, balancer := range c.RouterConfig.Balancers {
+			if err := balancer.ValidateSelectors(outboundTags); err != nil {
+				return nil, err
+			}
+		}
+		var err error
+		routerConfig, routerOrigins, err = c.RouterConfig.build()
 		if err != nil {
 			return nil, err
 		}
+		expandInboundTags(routerConfig, c.getInbounds())
 		config.App = append(config.App, serial.ToTypedMessage(routerConfig))
 	}
 
@@ -360,6 +564,19 @@ func (c *Config) Build() (*core.Config, error) {
 			return nil, newError("failed to parse DNS config").Base(err)
 		}
 		config.App = append(config.App, serial.ToTypedMessage(dnsApp))
+
+		if c.DNSConfig.FakeDNS != nil {
+			pool, err := c.DNSConfig.FakeDNS.Build()
+			if err != nil {
+				return nil, newError("failed to parse fake DNS config").Base(err)
+			}
+			if routerConfig != nil {
+				if err := c.DNSConfig.FakeDNS.validateRouting(c.RouterConfig, routerConfig, routerOrigins); err != nil {
+					return nil, err
+				}
+			}
+			config.App = append(config.App, serial.ToTypedMessage(pool))
+		}
 	}
 
 	if c.Policy != nil {
@@ -378,57 +595,46 @@ func (c *Config) Build() (*core.Config, error) {
 		config.App = append(config.App, serial.ToTypedMessage(r))
 	}
 
-	var inbounds []InboundDetourConfig
-
-	if c.InboundConfig != nil {
-		inbounds = append(inbounds, *c.InboundConfig)
-	}
-
-	if len(c.InboundDetours) > 0 {
-		inbounds = append(inbounds, c.InboundDetours...)
-	}
-
-	if len(c.InboundConfigs) > 0 {
-		inbounds = append(inbounds, c.InboundConfigs...)
+	streamProfiles := newStreamProfileResolver(c.StreamProfiles)
+	if err := streamProfiles.validate(); err != nil {
+		return nil, err
 	}
 
-	// Backward compatibility.
-	if len(inbounds) > 0 && inbounds[0].PortRange == nil && c.Port > 0 {
-		inbounds[0].PortRange = &PortRange{
-			From: uint32(c.Port),
-			To:   uint32(c.Port),
+	for _, rawInboundConfig := range c.getInbounds() {
+		streamSetting, err := streamProfiles.apply(rawInboundConfig.StreamSetting)
+		if err != nil {
+			return nil, newError("failed to apply stream profile to inbound ", rawInboundConfig.Tag).Base(err)
 		}
-	}
-
-	for _, rawInboundConfig := range inbounds {
+		rawInboundConfig.StreamSetting = streamSetting
 		if c.Transport != nil {
 			if rawInboundConfig.StreamSetting == nil {
 				rawInboundConfig.StreamSetting = &StreamConfig{}
 			}
 			applyTransportConfig(rawInboundConfig.StreamSetting, c.Transport)
 		}
-		ic, err := rawInboundConfig.Build()
+		ic, err := rawInboundConfig.BuildAll()
 		if err != nil {
 			return nil, err
 		}
-		config.Inbound = append(config.Inbound, ic)
+		config.Inbound = append(config.Inbound, ic...)
 	}
-
-	var outbounds []OutboundDetourConfig
-
-	if c.OutboundConfig != nil {
-		outbounds = append(outbounds, *c.OutboundConfig)
-	}
-
-	if len(c.OutboundDetours) > 0 {
-		outbounds = append(outbounds, c.OutboundDetours...)
-	}
-
-	if len(c.OutboundConfigs) > 0 {
-		outbounds = append(outbounds, c.OutboundConfigs...)
+	inboundTags := make(map[string]bool, len(config.Inbound))
+	for _, ic := range config.Inbound {
+		if len(ic.Tag) == 0 {
+			continue
+		}
+		if inboundTags[ic.Tag] {
+			return nil, newError("duplicate inbound tag: ", ic.Tag, ". Note that inbounds listening on multiple port ranges are tagged with the index of each range.")
+		}
+		inboundTags[ic.Tag] = true
 	}
 
-	for _, rawOutboundConfig := range outbounds {
+	for _, rawOutboundConfig := range c.getOutbounds() {
+		streamSetting, err := streamProfiles.apply(rawOutboundConfig.StreamSetting)
+		if err != nil {
+			return nil, newError("failed to apply stream profile to outbound ", rawOutboundConfig.Tag).Base(err)
+		}
+		rawOutboundConfig.StreamSetting = streamSetting
 		if c.Transport != nil {
 			if rawOutboundConfig.StreamSetting == nil {
 				rawOutboundConfig.StreamSetting = &StreamConfig{}
@@ -2,6 +2,8 @@ package conf_test
 
 import (
 	"encoding/json"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/golang/protobuf/proto"
@@ -11,6 +13,7 @@ import (
 	"v2ray.com/core/app/log"
 	"v2ray.com/core/app/proxyman"
 	"v2ray.com/core/app/router"
+	"v2ray.com/core/common"
 	clog "v2ray.com/core/common/log"
 	"v2ray.com/core/common/net"
 	"v2ray.com/core/common/protocol"
@@ -336,3 +339,192 @@ func TestV2RayConfig(t *testing.T) {
 		},
 	})
 }
+
+func TestInboundPortExpansion(t *testing.T) {
+	config := new(Config)
+	common.Must(json.Unmarshal([]byte(`{
+		"inbounds": [{
+			"tag": "in",
+			"protocol": "http",
+			"port": "1000,2000-2001"
+		}, {
+			"tag": "single",
+			"protocol": "http",
+			"port": 3000
+		}],
+		"outbounds": [{
+			"tag": "direct",
+			"protocol": "freedom"
+		}],
+		"routing": {
+			"rules": [{
+				"type": "field",
+				"inboundTag": ["in", "single"],
+				"outboundTag": "direct"
+			}]
+		}
+	}`), config))
+	actual, err := config.Build()
+	common.Must(err)
+
+	var tags []string
+	for _, inbound := range actual.Inbound {
+		tags = append(tags, inbound.Tag)
+	}
+	if !reflect.DeepEqual(tags, []string{"in-0", "in-1", "single"}) {
+		t.Error("unexpected inbound tags: ", tags)
+	}
+
+	var routerConfig *router.Config
+	for _, app := range actual.App {
+		if app.Type == serial.GetMessageType(new(router.Config)) {
+			instance, err := app.GetInstance()
+			common.Must(err)
+			routerConfig = instance.(*router.Config)
+		}
+	}
+	if routerConfig == nil {
+		t.Fatal("router config not found")
+	}
+	if inboundTags := routerConfig.Rule[0].InboundTag; !reflect.DeepEqual(inboundTags, []string{"in-0", "in-1", "single"}) {
+		t.Error("unexpected inbound tags in routing rule: ", inboundTags)
+	}
+}
+
+func TestInboundPortExpansionTagCollision(t *testing.T) {
+	config := new(Config)
+	common.Must(json.Unmarshal([]byte(`{
+		"inbounds": [{
+			"tag": "in",
+			"protocol": "http",
+			"port": "1000,2000"
+		}, {
+			"tag": "in-1",
+			"protocol": "http",
+			"port": 3000
+		}]
+	}`), config))
+	if _, err := config.Build(); err == nil || !strings.Contains(err.Error(), "duplicate inbound tag: in-1") {
+		t.Error("expected duplicate inbound tag, but got ", err)
+	}
+}
+
+func TestInboundDetourBuild(t *testing.T) {
+	inbound := new(InboundDetourConfig)
+	common.Must(json.Unmarshal([]byte(`{"tag": "in", "protocol": "http", "port": 1000}`), inbound))
+	if inbound.PortRange == nil || inbound.PortRange.From != 1000 || inbound.PortRange.To != 1000 {
+		t.Error("unexpected port range: ", inbound.PortRange)
+	}
+	handler, err := inbound.Build()
+	common.Must(err)
+	if handler.Tag != "in" {
+		t.Error("unexpected tag: ", handler.Tag)
+	}
+
+	common.Must(json.Unmarshal([]byte(`{"tag": "in", "protocol": "http", "port": "1000,2000"}`), inbound))
+	if _, err := inbound.Build(); err == nil || !strings.Contains(err.Error(), "multiple port ranges") {
+		t.Error("expected error for multiple port ranges, but got ", err)
+	}
+	handlers, err := inbound.BuildAll()
+	common.Must(err)
+	if len(handlers) != 2 {
+		t.Error("unexpected number of handlers: ", len(handlers))
+	}
+}
+
+func TestStreamProfiles(t *testing.T) {
+	build := func(s string) (*core.Config, error) {
+		config := new(Config)
+		if err := json.Unmarshal([]byte(s), config); err != nil {
+			return nil, err
+		}
+		return config.Build()
+	}
+
+	actual, err := build(`{
+		"streamProfiles": {
+			"tls": {
+				"security": "tls",
+				"tlsSettings": {"serverName": "v2ray.com"}
+			},
+			"cdn-ws": {
+				"Profile": "tls",
+				"network": "ws",
+				"wsSettings": {"path": "/a", "headers": {"Host": "cdn.v2ray.com"}}
+			}
+		},
+		"transport": {
+			"quicSettings": {"key": "secret"}
+		},
+		"outbounds": [{
+			"protocol": "freedom",
+			"streamSettings": {
+				"profile": "cdn-ws",
+				"WSSettings": {"Path": "/b"}
+			}
+		}, {
+			"protocol": "freedom",
+			"tag": "b",
+			"streamSettings": "cdn-ws"
+		}]
+	}`)
+	common.Must(err)
+
+	expected, err := build(`{
+		"transport": {
+			"quicSettings": {"key": "secret"}
+		},
+		"outbounds": [{
+			"protocol": "freedom",
+			"streamSettings": {
+				"network": "ws",
+				"security": "tls",
+				"tlsSettings": {"serverName": "v2ray.com"},
+				"wsSettings": {"path": "/b", "headers": {"Host": "cdn.v2ray.com"}},
+				"quicSettings": {"key": "secret"}
+			}
+		}, {
+			"protocol": "freedom",
+			"tag": "b",
+			"streamSettings": {
+				"network": "ws",
+				"security": "tls",
+				"tlsSettings": {"serverName": "v2ray.com"},
+				"wsSettings": {"path": "/a", "headers": {"Host": "cdn.v2ray.com"}},
+				"quicSettings": {"key": "secret"}
+			}
+		}]
+	}`)
+	common.Must(err)
+
+	if !proto.Equal(actual, expected) {
+		t.Error("unexpected config: ", actual)
+	}
+
+	parser := func(s string) (proto.Message, error) {
+		return build(s)
+	}
+	runMultiTestCase(t, []TestCase{
+		{
+			Input:  `{"outbounds": [{"protocol": "freedom", "streamSettings": "unknown"}]}`,
+			Parser: parser,
+			Error:  "stream profile not found: unknown",
+		},
+		{
+			Input:  `{"streamProfiles": {"a": {"profile": "b"}, "b": {"profile": "a"}}}`,
+			Parser: parser,
+			Error:  "cyclic inheritance of stream profiles",
+		},
+		{
+			Input:  `{"streamProfiles": {"a": {"network": 1}}}`,
+			Parser: parser,
+			Error:  "invalid stream profile a",
+		},
+	})
+
+	streamConfig := new(StreamConfig)
+	common.Must(json.Unmarshal([]byte(`"cdn-ws"`), streamConfig))
+	if _, err := streamConfig.Build(); err == nil || !strings.Contains(err.Error(), "stream profile cdn-ws is not resolved") {
+		t.Error("expected error for unresolved stream profile, but got ", err)
+	}
+}